@@ -18,25 +18,127 @@
 package cmd
 
 import (
+	"flag"
 	"fmt"
+	"os"
+	"slices"
+	"strings"
 	"time"
 
 	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/dashboard"
 	"kbbi-scraper/internal/database"
+	"kbbi-scraper/internal/httpcache"
+	"kbbi-scraper/internal/kbbi"
 	"kbbi-scraper/internal/kbbi/kata"
 	"kbbi-scraper/internal/kbbi/lema"
+	"kbbi-scraper/internal/pause"
+	"kbbi-scraper/internal/proxy"
+	"kbbi-scraper/internal/recorder"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/joho/godotenv"
+	"github.com/mattn/go-isatty"
 )
 
+const DEFAULT_PROVIDER = "scrapingant"
+
 func Execute() {
-	err := godotenv.Load()
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet("kbbi-scraper", flag.ContinueOnError)
+	shardFlag := flags.String("shard", "", "only handle shard `i/n` of the wordlist, e.g. 1/4")
+	proxyFlag := flags.String("proxy", "", "proxy for scrape: residential or datacenter, none when empty")
+	providerFlag := flags.String("provider", DEFAULT_PROVIDER, "first datacenter `provider` for scrape --proxy datacenter")
+	dashboardFlag := flags.Bool("dashboard", false, "show a full-screen dashboard while scraping, logging the details to DASHBOARD_LOG")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: kbbi-scraper [--shard i/n] [--dashboard]")
+		fmt.Fprintln(flags.Output(), "       kbbi-scraper scrape [--shard i/n] [--dashboard] [--proxy residential|datacenter] [--provider name] <source>...")
+		fmt.Fprintln(flags.Output(), "       kbbi-scraper export [--shard i/n] <file|->")
+		fmt.Fprintln(flags.Output(), "       kbbi-scraper merge <file>...")
+		fmt.Fprintln(flags.Output(), "       kbbi-scraper import-no-results <file>...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return
+	}
+
+	shard, err := lema.ParseShard(*shardFlag)
+	if err != nil {
+		common.PrintError("%v", err)
+		return
+	}
+
+	err = godotenv.Load()
 	if err != nil {
 		common.PrintError("Error loading .env file")
 		return
 	}
 
+	kbbi.SetRetryPolicy(kbbi.LoadRetryPolicy())
+
+	transportConfig, err := kbbi.LoadTransportConfig()
+	if err != nil {
+		common.PrintError("Error loading transport settings: %v", err)
+		return
+	}
+	if err := kbbi.SetTransportConfig(transportConfig); err != nil {
+		common.PrintError("Error loading transport settings: %v", err)
+		return
+	}
+
+	if err := common.LoadHeaderProfiles(); err != nil {
+		common.PrintError("Error loading header profiles: %v", err)
+		return
+	}
+
+	// The recorder comes first, so polite mode's robots.txt fetch is
+	// recorded and replayed with the rest of the traffic.
+	capture, err := recorder.Load()
+	if err != nil {
+		common.PrintError("Error opening capture file: %v", err)
+		return
+	}
+	if capture != nil {
+		defer capture.Close()
+	}
+	kbbi.SetRecorder(capture)
+
+	polite, err := kbbi.LoadPoliteness()
+	if err != nil {
+		common.PrintError("Error enabling polite mode: %v", err)
+		return
+	}
+	kbbi.SetPoliteness(polite)
+	if polite != nil && (*proxyFlag != "" || os.Getenv("KBBI_ACCOUNTS_FILE") != "" || os.Getenv("KBBI_ACCOUNTS") != "") {
+		common.PrintError("Polite mode does not rotate IPs or accounts, unset --proxy, KBBI_ACCOUNTS and KBBI_ACCOUNTS_FILE")
+		return
+	}
+
+	cache, err := httpcache.Load()
+	if err != nil {
+		common.PrintError("Error opening HTTP cache: %v", err)
+		return
+	}
+	kbbi.SetResponseCache(cache)
+
+	if err := proxy.LoadProviders(); err != nil {
+		common.PrintError("Error loading proxy providers: %v", err)
+		return
+	}
+	proxy.LoadGeo()
+	recorder.Redact(proxy.Secrets())
+	kbbi.SetBandwidthMeter(proxy.LoadMeter())
+
+	pause.ListenSignals()
+
+	if d := dashboard.Load(*dashboardFlag); d != nil {
+		lema.SetMonitor(d)
+	}
+
 	db, err := database.ConnectDB()
 	if err != nil {
 		common.PrintError("Error connecting to database: %v", err)
@@ -44,32 +146,25 @@ func Execute() {
 	}
 	defer database.CloseDB(db)
 
-	// if !common.CheckSessionExists() {
-	// 	email := common.GetInput("Enter your KBBI email: ")
-	// 	password := common.GetInput("Enter your KBBI password: ")
-
-	// 	if email == "" || password == "" {
-	// 		common.PrintError("Email or password cannot be empty")
-	// 		return
-	// 	}
-
-	// 	cookie, err := kbbi.LoginKBBI(email, password)
-	// 	if err != nil {
-	// 		common.PrintError("Error logging in to KBBI: %v", err)
-	// 		return
-	// 	}
-
-	// 	if cookie != nil {
-	// 		common.SaveSession(common.Session{
-	// 			Email:    email,
-	// 			Password: password,
-	// 			Cookie:   *cookie,
-	// 		})
-	// 	} else {
-	// 		common.PrintError("Error logging in to KBBI: cookie is nil")
-	// 		return
-	// 	}
-	// }
+	switch command {
+	case "":
+	case "scrape":
+		scrapeSources(db, flags.Args(), shard, *proxyFlag, *providerFlag)
+		return
+	case "export":
+		exportShard(db, flags.Args(), shard)
+		return
+	case "merge":
+		mergeShards(db, flags.Args())
+		return
+	case "import-no-results":
+		importNoResults(db, flags.Args())
+		return
+	default:
+		common.PrintError("Unknown command %q", command)
+		flags.Usage()
+		return
+	}
 
 	for {
 		common.DisplayMenu()
@@ -80,15 +175,31 @@ func Execute() {
 			getWordlistContent(db)
 			return
 		case "2":
+			accounts, err := kbbi.LoadAccountPool()
+			if err != nil {
+				common.PrintError("Error loading KBBI accounts: %v", err)
+				return
+			}
+
+			var session *kbbi.SessionManager
+			if accounts != nil {
+				common.PrintInfo("Rotating searches over %d KBBI accounts", accounts.Len())
+			} else {
+				session = getSession(false)
+			}
+
 			common.PrintInfo("Default wordlist source is local file")
-			typeWordList := common.GetInput("Choose wordlist source (local/db): ")
-			if typeWordList != "db" && typeWordList != "local" {
+			typeWordList := common.GetInput("Choose wordlist source (local/db/queue): ")
+			if typeWordList != "db" && typeWordList != "local" && typeWordList != "queue" {
 				typeWordList = "local"
 			}
 
-			searchWordlist(db, typeWordList)
+			searchWordlist(db, typeWordList, session, accounts, shard)
 			return
 		case "3":
+			manageJobs(db)
+			return
+		case "4":
 			common.PrintInfo("Thank you for using this program. See you soon!")
 			return
 		default:
@@ -99,19 +210,17 @@ func Execute() {
 	}
 }
 
-func searchWordlist(db *sqlx.DB, typeWordList string) {
+func searchWordlist(db *sqlx.DB, typeWordList string, session *kbbi.SessionManager, accounts *kbbi.AccountPool, shard lema.Shard) {
 	var words []string
+	var report lema.WordlistReport
 	if typeWordList == "local" {
-		filename := "word.txt"
-		wordsFile, err := lema.ReadWordsFromFile(filename)
+		wordsFile, reportFile, err := lema.LoadWordlist(lema.WordlistFiles(), db)
 		if err != nil {
-			common.PrintError("Error getting words from database: %v", err)
+			common.PrintError("Error reading wordlist: %v", err)
 			return
 		}
 
-		words = wordsFile
-		// Reverse string
-		// sort.Sort(sort.Reverse(sort.StringSlice(words)))
+		words, report = wordsFile, reportFile
 	} else if typeWordList == "db" {
 		wordsDB, err := database.GetWords(db)
 		if err != nil {
@@ -123,13 +232,37 @@ func searchWordlist(db *sqlx.DB, typeWordList string) {
 		for i, word := range wordsDB {
 			wordsLocal[i] = word.Kata
 		}
-		words = wordsLocal
-	} else {
+		words, report = lema.CleanWordlist(wordsLocal)
+	} else if typeWordList != "queue" {
 		common.PrintError("Invalid type word list")
 		return
 	}
 
-	common.PrintInfo("Read %d words from file", len(words))
+	order, err := lema.LoadOrder()
+	if err != nil {
+		common.PrintError("%v", err)
+		return
+	}
+
+	if typeWordList != "queue" {
+		report.Print()
+		if shard.Count > 1 {
+			words = shard.Filter(words)
+			common.PrintInfo("Shard %s has %d words", shard, len(words))
+		}
+		if words, err = order.Apply(words); err != nil {
+			common.PrintError("Error ordering words: %v", err)
+			return
+		}
+		common.PrintInfo("Scheduling words in %s order", order)
+	} else {
+		if shard.Count > 1 {
+			common.PrintWarning("Shard %s is ignored for the queue source, which is already shared", shard)
+		}
+		if order.Strategy != lema.OrderFile {
+			common.PrintWarning("Order %s is ignored for the queue source", order.Strategy)
+		}
+	}
 
 	withProxy := common.GetInput("Do you want to use proxy? (y/n): ")
 	var optionProxy string
@@ -147,43 +280,175 @@ func searchWordlist(db *sqlx.DB, typeWordList string) {
 		return
 	}
 
-	providerProxy := "scrapingant"
+	providerName := DEFAULT_PROVIDER
 	if optionProxy == "datacenter" {
-		common.PrintInfo("Default provider proxy is scrapingant")
-		chooseProviderProxy := common.GetInput("Choose provider proxy (scrapeops/scrapingant/scraperapi/scrapingbee): ")
-		if chooseProviderProxy != "scrapeops" && chooseProviderProxy != "scrapingant" && chooseProviderProxy != "scraperapi" && chooseProviderProxy != "scrapingbee" {
-			chooseProviderProxy = "scrapingant"
+		names := proxy.Names()
+		common.PrintInfo("Default provider proxy is %s", DEFAULT_PROVIDER)
+		chooseProviderProxy := common.GetInput(fmt.Sprintf("Choose provider proxy (%s): ", strings.Join(names, "/")))
+		if slices.Contains(names, chooseProviderProxy) {
+			providerName = chooseProviderProxy
 		}
-		providerProxy = chooseProviderProxy
 	}
 
-	batchSize := 100
-	concurrency := 10
+	r, err := newRunner(optionProxy, providerName, session, accounts)
+	if err != nil {
+		common.PrintError("%v", err)
+		return
+	}
+
+	if err := database.EnqueueJobs(db, words); err != nil {
+		common.PrintError("Error queueing words: %v", err)
+		return
+	}
+
+	listenPauseKeys()
+
+	// The queue source works off the shared jobs table, so any number of
+	// processes can join the same run.
+	var summary lema.Summary
+	if typeWordList == "queue" {
+		summary = lema.ProcessQueue(r.batchSize, r.concurrency, db, r.opts)
+	} else {
+		summary = lema.ProcessBatch(words, r.batchSize, r.concurrency, db, r.opts)
+	}
+
+	r.printSummary(summary)
+}
+
+// runner holds the search options and pool size of one scraping run.
+type runner struct {
+	opts        kbbi.SearchOptions
+	batchSize   int
+	concurrency int
+}
+
+// newRunner sets up the proxy for optionProxy, which is "", "residential"
+// or "datacenter". providerName heads the failover chain of datacenter
+// runs.
+func newRunner(optionProxy, providerName string, session *kbbi.SessionManager, accounts *kbbi.AccountPool) (*runner, error) {
+	if kbbi.PoliteMode() && (optionProxy != "" || accounts != nil) {
+		return nil, fmt.Errorf("polite mode cannot be used with a proxy or an account pool")
+	}
+
+	var proxies *proxy.Pool
+	if optionProxy == "residential" {
+		pool, err := loadResidentialProxies()
+		if err != nil {
+			return nil, fmt.Errorf("error loading proxies: %w", err)
+		}
+		proxies = pool
+	}
+
+	var provider proxy.Provider
+	var chain *proxy.Chain
 	if optionProxy == "datacenter" {
-		if providerProxy == "scrapeops" || providerProxy == "scrapingant" {
-			concurrency = 1
-			batchSize = 10
-		} else if providerProxy == "scraperapi" || providerProxy == "scrapingbee" {
-			concurrency = 5
-			batchSize = 50
+		c, err := proxy.LoadChain(providerName)
+		if err != nil {
+			return nil, fmt.Errorf("error building provider chain: %w", err)
 		}
+		chain = c
+		provider = chain.First()
 	}
 
-	start := time.Now()
-	lema.ProcessBatch(words, batchSize, concurrency, db, optionProxy, providerProxy)
-	duration := time.Since(start)
+	r := &runner{batchSize: 100, concurrency: 10}
+	if provider != nil {
+		limits := provider.Limits()
+		r.concurrency = limits.Concurrency
+		r.batchSize = limits.BatchSize
+	}
+	// Each account serves one search at a time, so more workers would only
+	// wait for a free account.
+	if accounts != nil && r.concurrency > accounts.Len() {
+		r.concurrency = accounts.Len()
+	}
 
-	common.PrintInfo("Total execution time: %v", duration)
+	r.opts = kbbi.SearchOptions{
+		OptionProxy: optionProxy,
+		Provider:    provider,
+		Session:     session,
+		Accounts:    accounts,
+		Proxies:     proxies,
+		Chain:       chain,
+		Ledger:      proxy.LoadLedger(),
+	}
+	return r, nil
+}
+
+func (r *runner) printSummary(summary lema.Summary) {
+	summary.Print()
+	r.opts.Ledger.PrintSummary()
+	kbbi.BandwidthMeter().PrintSummary()
+
+	if r.opts.Chain != nil {
+		for _, status := range r.opts.Chain.Status() {
+			common.PrintInfo("Provider %s: circuit %s, %d consecutive failures", status.Name, status.State, status.Failures)
+		}
+	}
+
+	if r.opts.Proxies != nil {
+		for _, status := range r.opts.Proxies.Status() {
+			if status.Failures > 0 {
+				common.PrintInfo("Proxy %s: %d failures", status.URL, status.Failures)
+			}
+		}
+	}
+
+	if r.opts.Accounts != nil {
+		r.opts.Accounts.Flush()
+		for _, status := range r.opts.Accounts.Status() {
+			if status.Reason != "" {
+				common.PrintInfo("Account %s: %d searches today, parked until %s (%s)", status.Email, status.Used, status.ParkedUntil.Format(time.DateTime), status.Reason)
+			} else {
+				common.PrintInfo("Account %s: %d searches today", status.Email, status.Used)
+			}
+		}
+	}
+}
+
+// loadResidentialProxies uses the proxy list from PROXY_LIST_FILE or
+// PROXY_LIST when set, health-checking it first, and the ScrapeOps
+// residential gateway otherwise.
+func loadResidentialProxies() (*proxy.Pool, error) {
+	pool, err := proxy.LoadPool()
+	if err != nil {
+		return nil, err
+	}
+
+	if pool == nil {
+		// A single rotating gateway must never be ejected.
+		config := proxy.LoadPoolConfig()
+		config.Cooldown = 0
+		return proxy.NewPool(common.GetProxyResidential(), config)
+	}
+
+	if kbbi.Replaying() {
+		common.PrintInfo("Replaying a capture, skipping the proxy health check")
+		return pool, nil
+	}
+
+	pool.SetTransport(kbbi.HealthTransport)
+	common.PrintInfo("Checking %d proxies", pool.Len())
+	healthy := pool.CheckHealth()
+	if healthy == 0 {
+		return nil, proxy.ErrNoHealthyProxy
+	}
+	common.PrintInfo("%d/%d proxies are healthy", healthy, pool.Len())
+
+	return pool, nil
 }
 
 func getWordlistContent(db *sqlx.DB) {
-	email := common.GetInput("Enter your KBBI email: ")
-	password := common.GetInput("Enter your KBBI password: ")
+	session := getSession(true)
+	if session == nil {
+		return
+	}
 
 	concurrency := 10
 
+	listenPauseKeys()
+
 	start := time.Now()
-	err := kata.GetWordList(db, email, password, concurrency)
+	err := kata.GetWordList(db, session, concurrency)
 	if err != nil {
 		common.PrintError("Error getting wordlist: %v", err)
 		return
@@ -192,3 +457,127 @@ func getWordlistContent(db *sqlx.DB) {
 
 	common.PrintInfo("Total execution time: %v", duration)
 }
+
+// listenPauseKeys lets Enter pause and resume the run once all questions
+// are answered, since it takes over stdin from then on.
+func listenPauseKeys() {
+	if !isatty.IsTerminal(os.Stdin.Fd()) && !isatty.IsCygwinTerminal(os.Stdin.Fd()) {
+		return
+	}
+
+	common.PrintInfo("Press Enter to pause or resume (or send SIGUSR1/SIGUSR2 to pid %d)", os.Getpid())
+	go pause.ListenKeys(os.Stdin)
+}
+
+// getSession picks the KBBI account from KBBI_EMAIL/KBBI_PASSWORD, then the
+// saved session file, then asks for it. Searching works without an account,
+// so unless required the user may skip logging in.
+func getSession(required bool) *kbbi.SessionManager {
+	if session := savedSession(); session != nil {
+		return session
+	}
+
+	if !required {
+		withLogin := common.GetInput("Do you want to login to KBBI? (y/n): ")
+		if withLogin != "y" {
+			return nil
+		}
+	}
+
+	email := common.GetInput("Enter your KBBI email: ")
+	password := common.GetInput("Enter your KBBI password: ")
+	if email == "" || password == "" {
+		common.PrintError("Email or password cannot be empty")
+		return nil
+	}
+
+	session := kbbi.NewSessionManager(email, password)
+	if _, err := session.Cookie(); err != nil {
+		common.PrintError("Error logging in to KBBI: %v", err)
+		return nil
+	}
+
+	return session
+}
+
+// savedSession logs in with KBBI_EMAIL and KBBI_PASSWORD or restores the
+// saved session, without asking. It returns nil when neither is there.
+func savedSession() *kbbi.SessionManager {
+	email := os.Getenv("KBBI_EMAIL")
+	password := os.Getenv("KBBI_PASSWORD")
+	if email != "" && password != "" {
+		return kbbi.NewSessionManager(email, password)
+	}
+
+	if common.CheckSessionExists() {
+		session, err := kbbi.NewSessionManagerFromFile()
+		if err == nil {
+			common.PrintInfo("Using saved session for %s", session.Email())
+			return session
+		}
+		common.PrintWarning("Could not restore session: %v", err)
+	}
+
+	return nil
+}
+
+// manageJobs shows the job queue and moves dead-lettered or failed words
+// back to pending so the next run picks them up again.
+func manageJobs(db *sqlx.DB) {
+	counts, err := database.CountJobs(db)
+	if err != nil {
+		common.PrintError("Error counting jobs: %v", err)
+		return
+	}
+
+	common.PrintInfo("Jobs by status:")
+	for _, count := range counts {
+		fmt.Printf("  %-12s %d\n", count.Status, count.Count)
+	}
+
+	action := common.GetInput("Choose action (list/requeue): ")
+	if action != "list" && action != "requeue" {
+		common.PrintError("Invalid action")
+		return
+	}
+
+	status := common.GetInput(fmt.Sprintf("Status (%s, default %s): ", strings.Join(database.JobStatuses, "/"), database.JobDeadLetter))
+	if status == "" {
+		status = database.JobDeadLetter
+	}
+	if !slices.Contains(database.JobStatuses, status) {
+		common.PrintError("Invalid status %q", status)
+		return
+	}
+
+	switch action {
+	case "list":
+		jobs, err := database.ListJobs(db, status, 100)
+		if err != nil {
+			common.PrintError("Error listing jobs: %v", err)
+			return
+		}
+		for _, job := range jobs {
+			fmt.Printf("  %s attempts=%d provider=%s updated=%s\n", job.Kata, job.Attempts, job.LastProvider.String, job.UpdatedAt.Format(time.DateTime))
+			if job.Status == database.JobInProgress && job.LeaseOwner.Valid {
+				fmt.Printf("    leased by %s until %s\n", job.LeaseOwner.String, job.LeaseExpiresAt.Time.Format(time.DateTime))
+			}
+			if job.LastError.Valid {
+				common.PrintError("    %s", strings.TrimSpace(job.LastError.String))
+			}
+		}
+		common.PrintInfo("Listed %d %s jobs", len(jobs), status)
+	case "requeue":
+		var words []string
+		if word := common.GetInput("Word to requeue (empty for all): "); word != "" {
+			words = append(words, word)
+		}
+
+		n, err := database.RequeueJobs(db, status, words)
+		if err != nil {
+			common.PrintError("Error requeueing jobs: %v", err)
+			return
+		}
+		common.PrintSuccess("Requeued %d %s jobs", n, status)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"slices"
+
+	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/database"
+	"kbbi-scraper/internal/kbbi"
+	"kbbi-scraper/internal/kbbi/lema"
+	"kbbi-scraper/internal/proxy"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// scrapeSources is the non-interactive counterpart of the wordlist menu.
+// Words are streamed from the sources, so stdin can be one of them and
+// nothing is asked on the terminal.
+func scrapeSources(db *sqlx.DB, specs []string, shard lema.Shard, optionProxy, providerName string) {
+	if len(specs) == 0 {
+		common.PrintError("scrape needs at least one source, or - for stdin")
+		return
+	}
+
+	switch optionProxy {
+	case "", "residential":
+	case "datacenter":
+		if !slices.Contains(proxy.Names(), providerName) {
+			common.PrintError("Unknown provider %q", providerName)
+			return
+		}
+	default:
+		common.PrintError("Invalid proxy %q, expected residential or datacenter", optionProxy)
+		return
+	}
+
+	accounts, err := kbbi.LoadAccountPool()
+	if err != nil {
+		common.PrintError("Error loading KBBI accounts: %v", err)
+		return
+	}
+
+	var session *kbbi.SessionManager
+	if accounts != nil {
+		common.PrintInfo("Rotating searches over %d KBBI accounts", accounts.Len())
+	} else {
+		session = savedSession()
+	}
+
+	r, err := newRunner(optionProxy, providerName, session, accounts)
+	if err != nil {
+		common.PrintError("%v", err)
+		return
+	}
+
+	// With words coming from stdin, only the signals can pause the run.
+	if !slices.Contains(specs, "-") {
+		listenPauseKeys()
+	}
+
+	order, err := lema.LoadOrder()
+	if err != nil {
+		common.PrintError("%v", err)
+		return
+	}
+
+	if order.Strategy == lema.OrderFile {
+		source := lema.OpenSources(specs, db)
+		defer source.Close()
+
+		summary, report := lema.ProcessStream(source, shard, r.batchSize, r.concurrency, db, r.opts)
+		report.Files = len(specs)
+		report.Print()
+		r.printSummary(summary)
+		return
+	}
+
+	// Any other order needs the whole list before the first word goes out.
+	common.PrintInfo("Reading every source first to schedule words in %s order", order)
+	words, report, err := lema.LoadWordlist(specs, db)
+	if err != nil {
+		common.PrintError("Error reading wordlist: %v", err)
+		return
+	}
+	report.Print()
+
+	words = shard.Filter(words)
+	if words, err = order.Apply(words); err != nil {
+		common.PrintError("Error ordering words: %v", err)
+		return
+	}
+	if err := database.EnqueueJobs(db, words); err != nil {
+		common.PrintError("Error queueing words: %v", err)
+		return
+	}
+
+	r.printSummary(lema.ProcessBatch(words, r.batchSize, r.concurrency, db, r.opts))
+}
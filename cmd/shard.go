@@ -0,0 +1,96 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/kbbi/lema"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// exportShard writes the results of this machine, limited to shard, so
+// they can be merged with the other shards elsewhere.
+func exportShard(db *sqlx.DB, args []string, shard lema.Shard) {
+	if len(args) != 1 {
+		common.PrintError("export needs exactly one output file, or - for stdout")
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if args[0] != "-" {
+		file, err := os.Create(args[0])
+		if err != nil {
+			common.PrintError("Error creating export: %v", err)
+			return
+		}
+		defer file.Close()
+		w = file
+	}
+
+	stats, err := lema.Export(db, w, shard)
+	if err != nil {
+		common.PrintError("%v", err)
+		return
+	}
+
+	if args[0] != "-" {
+		common.PrintSuccess("Exported %d lemas and %d no-result words of shard %s to %s", stats.Lemas, stats.NoResult, shard, args[0])
+	}
+}
+
+func mergeShards(db *sqlx.DB, files []string) {
+	if len(files) == 0 {
+		common.PrintError("merge needs at least one export file")
+		return
+	}
+
+	stats, err := lema.Merge(db, files)
+	if err != nil {
+		common.PrintError("Error merging after %d lemas: %v", stats.Lemas, err)
+		return
+	}
+	common.PrintSuccess("Merged %d lemas and %d no-result words, skipped %d duplicate rows", stats.Lemas, stats.NoResult, stats.Duplicates)
+}
+
+// importNoResults adds no-result lists in the old no_result_word.json
+// format to the no_results table.
+func importNoResults(db *sqlx.DB, files []string) {
+	if len(files) == 0 {
+		common.PrintError("import-no-results needs at least one JSON file")
+		return
+	}
+
+	store, err := lema.LoadNoResultStore(db)
+	if err != nil {
+		common.PrintError("%v", err)
+		return
+	}
+
+	for _, file := range files {
+		n, err := store.Import(file)
+		if err != nil {
+			common.PrintError("%v", err)
+			return
+		}
+		common.PrintSuccess("Imported %d new no-result words from %s", n, file)
+	}
+}
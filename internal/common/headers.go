@@ -0,0 +1,143 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package common
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	HEADER_PROFILES_FILE = "header_profiles.json"
+	HEADER_CACHE_FILE    = "header_cache.json"
+)
+
+// HeaderProfile is a consistent set of browser headers (User-Agent, Accept,
+// sec-ch-* and friends) that is kept for a whole session.
+type HeaderProfile map[string]string
+
+type headerCache struct {
+	FetchedAt time.Time       `json:"fetched_at"`
+	Profiles  []HeaderProfile `json:"profiles"`
+}
+
+//go:embed header_profiles.json
+var bundledHeaderProfiles []byte
+
+var (
+	headerProfilesMu sync.RWMutex
+	headerProfiles   []HeaderProfile
+)
+
+// LoadHeaderProfiles picks the header profiles for this run. HEADER_SOURCE
+// selects "bundled" (HEADER_PROFILES_FILE when present, otherwise the copy
+// built into the binary), "scrapeops" (fetched once and cached in
+// header_cache.json for HEADER_CACHE_TTL) or "auto", which uses ScrapeOps
+// only when SCRAPE_OPS is set.
+func LoadHeaderProfiles() error {
+	profiles, err := loadBundledHeaderProfiles()
+	if err != nil {
+		return err
+	}
+
+	source := GetEnvString("HEADER_SOURCE", "auto")
+	if source == "scrapeops" || (source == "auto" && os.Getenv("SCRAPE_OPS") != "") {
+		fetched, err := loadScrapeOpsHeaderProfiles(GetEnvDuration("HEADER_CACHE_TTL", 24*time.Hour))
+		if err != nil {
+			PrintWarning("Using bundled header profiles: %v", err)
+		} else if len(fetched) > 0 {
+			profiles = fetched
+		}
+	}
+
+	headerProfilesMu.Lock()
+	headerProfiles = profiles
+	headerProfilesMu.Unlock()
+
+	return nil
+}
+
+func loadBundledHeaderProfiles() ([]HeaderProfile, error) {
+	data := bundledHeaderProfiles
+
+	path := GetEnvString("HEADER_PROFILES_FILE", HEADER_PROFILES_FILE)
+	if fileData, err := os.ReadFile(path); err == nil {
+		data = fileData
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading header profiles: %w", err)
+	}
+
+	var profiles []HeaderProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("error parsing header profiles: %w", err)
+	}
+
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("header profiles are empty")
+	}
+
+	return profiles, nil
+}
+
+func loadScrapeOpsHeaderProfiles(ttl time.Duration) ([]HeaderProfile, error) {
+	if data, err := os.ReadFile(HEADER_CACHE_FILE); err == nil {
+		var cache headerCache
+		if err := json.Unmarshal(data, &cache); err == nil && time.Since(cache.FetchedAt) < ttl && len(cache.Profiles) > 0 {
+			return cache.Profiles, nil
+		}
+	}
+
+	headersList := GetHeadersList()
+	if len(headersList) == 0 {
+		return nil, fmt.Errorf("ScrapeOps returned no headers")
+	}
+
+	profiles := make([]HeaderProfile, 0, len(headersList))
+	for _, headers := range headersList {
+		profiles = append(profiles, HeaderProfile(headers))
+	}
+
+	data, err := json.Marshal(headerCache{
+		FetchedAt: time.Now(),
+		Profiles:  profiles,
+	})
+	if err == nil {
+		if err := os.WriteFile(HEADER_CACHE_FILE, data, 0644); err != nil {
+			PrintWarning("Error caching header profiles: %v", err)
+		}
+	}
+
+	return profiles, nil
+}
+
+// RandomHeaderProfile returns one of the loaded profiles, or nil when none
+// are loaded.
+func RandomHeaderProfile() HeaderProfile {
+	headerProfilesMu.RLock()
+	defer headerProfilesMu.RUnlock()
+
+	if len(headerProfiles) == 0 {
+		return nil
+	}
+	return headerProfiles[rand.Intn(len(headerProfiles))]
+}
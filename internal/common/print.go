@@ -19,6 +19,9 @@ package common
 
 import (
 	"fmt"
+	"io"
+	"log"
+	"os"
 	"strings"
 
 	"github.com/fatih/color"
@@ -30,8 +33,29 @@ var (
 	infoPrinter    = color.New(color.FgBlue)
 	warningPrinter = color.New(color.FgYellow)
 	defaultPrinter = color.New(color.FgWhite)
+
+	console io.Writer = os.Stdout
 )
 
+// RedirectOutput sends every Print* message and the standard logger to w
+// without colors, for when something else owns the terminal. The returned
+// function restores the terminal output.
+func RedirectOutput(w io.Writer) (restore func()) {
+	prevConsole, prevColor, prevNoColor, prevLog := console, color.Output, color.NoColor, log.Writer()
+
+	console = w
+	color.Output = w
+	color.NoColor = true
+	log.SetOutput(w)
+
+	return func() {
+		console = prevConsole
+		color.Output = prevColor
+		color.NoColor = prevNoColor
+		log.SetOutput(prevLog)
+	}
+}
+
 func PrintMessage(format string, a ...interface{}) {
 	message := fmt.Sprintf(format, a...)
 	message = strings.TrimSpace(message)
@@ -62,7 +86,7 @@ func printEventMessage(event, content string) {
 		printer = defaultPrinter
 	}
 
-	fmt.Printf("[%s] ", event)
+	fmt.Fprintf(console, "[%s] ", event)
 	printer.Println(content)
 }
 
@@ -82,6 +106,12 @@ func PrintWarning(format string, a ...interface{}) {
 	PrintMessage("[WARNING] "+format, a...)
 }
 
+// Printf writes plain, uncolored text to the console, for indented detail
+// lines that PrintMessage would trim.
+func Printf(format string, a ...interface{}) {
+	fmt.Fprintf(console, format, a...)
+}
+
 func PrintCustom(format string, textColor color.Attribute, isBold bool, a ...interface{}) {
 	printer := color.New(textColor)
 	if isBold {
@@ -94,8 +124,9 @@ func DisplayMenu() {
 	PrintCustom("=== Menu Wordlist ===", color.FgHiMagenta, true)
 	PrintCustom("1. Find Wordlist (Alpha)", color.FgHiMagenta, true)
 	PrintCustom("2. Fetch Wordlist Contents", color.FgHiMagenta, true)
-	PrintCustom("3. Quit", color.FgHiMagenta, true)
-	fmt.Print("Choose an option (1-3): ")
+	PrintCustom("3. Manage Jobs", color.FgHiMagenta, true)
+	PrintCustom("4. Quit", color.FgHiMagenta, true)
+	fmt.Print("Choose an option (1-4): ")
 }
 
 func GetUserChoice() string {
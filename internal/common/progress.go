@@ -21,15 +21,25 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"sync"
 )
 
 const PROGRESS_FILE = "scrape_progress.json"
 
+// LETTER_FINISHED marks a letter whose last page was scraped.
+const LETTER_FINISHED = -1
+
+// Progress keeps the next page of every letter, as letters are crawled
+// concurrently. CurrentLetter and CurrentPage are the single-letter format
+// of older versions and are only read.
 type Progress struct {
-	CurrentLetter string `json:"current_letter"`
-	CurrentPage   int    `json:"current_page"`
+	Letters       map[string]int `json:"letters"`
+	CurrentLetter string         `json:"current_letter,omitempty"`
+	CurrentPage   int            `json:"current_page,omitempty"`
 }
 
+var progressMu sync.Mutex
+
 func SaveProgress(p Progress) {
 	data, err := json.Marshal(p)
 	if err != nil {
@@ -43,22 +53,45 @@ func SaveProgress(p Progress) {
 	}
 }
 
+// SaveLetterProgress records page as the next page of letter, or
+// LETTER_FINISHED, keeping the entries of the other letters.
+func SaveLetterProgress(letter string, page int) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	p := LoadProgress()
+	p.Letters[letter] = page
+	SaveProgress(p)
+}
+
+// LoadProgress reads the progress file. A file in the old format is
+// converted: the letters before CurrentLetter count as finished.
 func LoadProgress() Progress {
+	p := Progress{Letters: map[string]int{}}
+
 	data, err := os.ReadFile(PROGRESS_FILE)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return Progress{}
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading progress file: %v", err)
 		}
-		log.Printf("Error reading progress file: %v", err)
-		return Progress{}
+		return p
 	}
 
-	var p Progress
-	err = json.Unmarshal(data, &p)
-	if err != nil {
+	if err := json.Unmarshal(data, &p); err != nil {
 		log.Printf("Error unmarshaling progress: %v", err)
-		return Progress{}
+		return Progress{Letters: map[string]int{}}
+	}
+	if p.Letters == nil {
+		p.Letters = map[string]int{}
+	}
+
+	if p.CurrentLetter != "" && len(p.Letters) == 0 {
+		for letter := 'A'; letter < rune(p.CurrentLetter[0]); letter++ {
+			p.Letters[string(letter)] = LETTER_FINISHED
+		}
+		p.Letters[p.CurrentLetter[:1]] = p.CurrentPage
 	}
+	p.CurrentLetter, p.CurrentPage = "", 0
 
 	return p
 }
@@ -20,9 +20,7 @@ package common
 import (
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/http"
-	"net/url"
 	"os"
 	"time"
 )
@@ -31,23 +29,9 @@ type FakeBrowserHeadersResponse struct {
 	Result []map[string]string `json:"result"`
 }
 
-const SCRAPEOPS_FAKE_BROWSER_ENDPOINT = "http://headers.scrapeops.io/v1/browser-headers?api_key="
-
-var proxyEndpoints = map[string]string{
-	"scrapeops":   "https://proxy.scrapeops.io/v1/",
-	"scrapingant": "https://api.scrapingant.com/v2/general",
-	"scraperapi":  "http://api.scraperapi.com",
-	"scrapingbee": "https://app.scrapingbee.com/api/v1/",
-}
-
-func RandomHeader(headersList []map[string]string) map[string]string {
-	if len(headersList) == 0 {
-		return map[string]string{}
-	}
+const KBBI_COOKIE_NAME = ".AspNet.ApplicationCookie"
 
-	randomIndex := rand.Intn(len(headersList))
-	return headersList[randomIndex]
-}
+const SCRAPEOPS_FAKE_BROWSER_ENDPOINT = "http://headers.scrapeops.io/v1/browser-headers?api_key="
 
 func GetHeadersList() []map[string]string {
 	scrapeopsAPIKey := os.Getenv("SCRAPE_OPS")
@@ -72,43 +56,14 @@ func GetHeadersList() []map[string]string {
 	return emptySlice
 }
 
+// GetProxyResidential returns the ScrapeOps residential gateway. The
+// {country} and {session} placeholders are filled in per request by the
+// proxy pool.
 func GetProxyResidential() []string {
 	scrapeopsAPIKey := os.Getenv("SCRAPE_OPS")
 	proxyList := []string{
-		fmt.Sprintf("http://scrapeops.country=jp:%s@residential-proxy.scrapeops.io:8181", scrapeopsAPIKey),
+		fmt.Sprintf("http://scrapeops.country={country}.sticky_session={session}:%s@residential-proxy.scrapeops.io:8181", scrapeopsAPIKey),
 	}
 
 	return proxyList
 }
-
-func GetProxyDataCenter(urlKbbi, providerProxy string) (string, error) {
-	endpoint, ok := proxyEndpoints[providerProxy]
-	if !ok {
-		return "", fmt.Errorf("unknown provider: %s", providerProxy)
-	}
-
-	u, err := url.Parse(endpoint)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse url: %w", err)
-	}
-	q := u.Query()
-	q.Set("url", urlKbbi)
-
-	switch providerProxy {
-	case "scrapeops":
-		q.Set("country", "jp")
-		q.Set("api_key", os.Getenv("SCRAPE_OPS"))
-	case "scrapingant":
-		q.Set("browser", "false")
-		q.Set("proxy_country", "ID")
-		q.Set("x-api-key", os.Getenv("SCRAPING_ANT"))
-	case "scraperapi":
-		q.Set("api_key", os.Getenv("SCRAPER_API"))
-	case "scrapingbee":
-		q.Set("render_js", "false")
-		q.Set("api_key", os.Getenv("SCRAPING_BEE"))
-	}
-
-	u.RawQuery = q.Encode()
-	return u.String(), nil
-}
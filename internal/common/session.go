@@ -21,9 +21,15 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
 )
 
-const SESSION_FILE = "session.json"
+const (
+	SESSION_FILE = "session.json"
+	SESSION_DIR  = "sessions"
+)
 
 type Session struct {
 	Email    string `json:"email"`
@@ -31,26 +37,54 @@ type Session struct {
 	Cookie   string `json:"cookie"`
 }
 
+// SessionFileFor returns the session file of one account of an account
+// pool, so pooled accounts do not overwrite each other's cookie.
+func SessionFileFor(email string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(email))
+
+	return filepath.Join(SESSION_DIR, name+".json")
+}
+
 func CheckSessionExists() bool {
 	_, err := os.Stat(SESSION_FILE)
 	return !os.IsNotExist(err)
 }
 
 func SaveSession(s Session) {
+	SaveSessionFile(SESSION_FILE, s)
+}
+
+func LoadSession() Session {
+	return LoadSessionFile(SESSION_FILE)
+}
+
+func SaveSessionFile(path string, s Session) {
 	data, err := json.Marshal(s)
 	if err != nil {
 		log.Printf("Error marshaling session: %v", err)
 		return
 	}
 
-	err = os.WriteFile(SESSION_FILE, data, 0644)
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Printf("Error creating session directory: %v", err)
+			return
+		}
+	}
+
+	err = os.WriteFile(path, data, 0600)
 	if err != nil {
 		log.Printf("Error saving session: %v", err)
 	}
 }
 
-func LoadSession() Session {
-	data, err := os.ReadFile(PROGRESS_FILE)
+func LoadSessionFile(path string) Session {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return Session{}
@@ -0,0 +1,54 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package common
+
+import (
+	"net/url"
+	"strings"
+)
+
+const KBBI_HOST = "kbbi.kemdikbud.go.id"
+
+// CanonicalKBBIURL returns the KBBI page a request is about. Requests to a
+// scraping API carry the KBBI URL as a query parameter, which is unwrapped
+// so the same page is recognised whichever provider fetched it. It returns
+// nil when u does not point at KBBI at all.
+func CanonicalKBBIURL(u *url.URL) *url.URL {
+	if u == nil {
+		return nil
+	}
+
+	if strings.EqualFold(u.Hostname(), KBBI_HOST) {
+		canonical := *u
+		canonical.Scheme = "https"
+		canonical.Host = KBBI_HOST
+		canonical.Fragment = ""
+		return &canonical
+	}
+
+	for _, values := range u.Query() {
+		for _, value := range values {
+			inner, err := url.Parse(value)
+			if err == nil && strings.EqualFold(inner.Hostname(), KBBI_HOST) {
+				return CanonicalKBBIURL(inner)
+			}
+		}
+	}
+
+	return nil
+}
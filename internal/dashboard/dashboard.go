@@ -0,0 +1,398 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package dashboard
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/kbbi"
+	"kbbi-scraper/internal/kbbi/lema"
+	"kbbi-scraper/internal/pause"
+	"kbbi-scraper/internal/proxy"
+
+	"github.com/mattn/go-isatty"
+)
+
+const (
+	DEFAULT_LOG_FILE = "scrape.log"
+	maxErrors        = 8
+	maxLineWidth     = 120
+	barWidth         = 40
+)
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiCyan   = "\x1b[36m"
+)
+
+// Dashboard redraws a full-screen summary of a run on the terminal while
+// the per-word output goes to a log file. It implements lema.Monitor.
+type Dashboard struct {
+	logFile  string
+	interval time.Duration
+	out      io.Writer
+
+	mu      sync.Mutex
+	total   int
+	opts    kbbi.SearchOptions
+	summary lema.Summary
+	start   time.Time
+	recent  []time.Time
+	errors  []string
+
+	log     *os.File
+	restore func()
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func New(logFile string, interval time.Duration) *Dashboard {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &Dashboard{logFile: logFile, interval: interval, out: os.Stdout}
+}
+
+// Load returns a dashboard when enabled is set or DASHBOARD=true, logging
+// to DASHBOARD_LOG. It returns nil when stdout is not a terminal.
+func Load(enabled bool) *Dashboard {
+	if !enabled && !common.GetEnvBool("DASHBOARD", false) {
+		return nil
+	}
+	if !isatty.IsTerminal(os.Stdout.Fd()) && !isatty.IsCygwinTerminal(os.Stdout.Fd()) {
+		common.PrintWarning("Dashboard needs a terminal, falling back to plain output")
+		return nil
+	}
+
+	logFile := os.Getenv("DASHBOARD_LOG")
+	if logFile == "" {
+		logFile = DEFAULT_LOG_FILE
+	}
+	return New(logFile, common.GetEnvDuration("DASHBOARD_REFRESH", time.Second))
+}
+
+func (d *Dashboard) Start(total int, opts kbbi.SearchOptions) {
+	file, err := os.OpenFile(d.logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		common.PrintError("Error opening dashboard log, falling back to plain output: %v", err)
+		return
+	}
+
+	d.mu.Lock()
+	d.total = total
+	d.opts = opts
+	d.summary = lema.Summary{Total: total}
+	d.start = time.Now()
+	d.recent = nil
+	d.errors = nil
+	d.mu.Unlock()
+
+	d.log = file
+	d.restore = common.RedirectOutput(file)
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+
+	// Switch to the alternate screen so the shell scrollback survives.
+	fmt.Fprint(d.out, "\x1b[?1049h\x1b[?25l")
+	go d.loop()
+}
+
+func (d *Dashboard) Result(summary lema.Summary, result lema.WordResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.summary = summary
+	d.summary.Failures = nil
+
+	now := time.Now()
+	d.recent = append(d.recent, now)
+	for len(d.recent) > 0 && now.Sub(d.recent[0]) > time.Minute {
+		d.recent = d.recent[1:]
+	}
+
+	if result.Err != nil {
+		line := fmt.Sprintf("%s %s: %v", now.Format(time.TimeOnly), result.Word, result.Err)
+		d.errors = append(d.errors, line)
+		if len(d.errors) > maxErrors {
+			d.errors = d.errors[len(d.errors)-maxErrors:]
+		}
+	}
+}
+
+func (d *Dashboard) Stop() {
+	if d.stop == nil {
+		return
+	}
+	close(d.stop)
+	<-d.done
+	d.stop = nil
+
+	fmt.Fprint(d.out, "\x1b[?25h\x1b[?1049l")
+	d.restore()
+	d.log.Close()
+	common.PrintInfo("Detailed output of the run was written to %s", d.logFile)
+}
+
+func (d *Dashboard) loop() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		d.draw()
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// draw writes the frame over the previous one line by line instead of
+// clearing the screen first, which would flicker.
+func (d *Dashboard) draw() {
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for _, line := range d.frame() {
+		b.WriteString(truncate(line, maxLineWidth))
+		b.WriteString(ansiReset + "\x1b[K\n")
+	}
+	b.WriteString("\x1b[J")
+	fmt.Fprint(d.out, b.String())
+}
+
+func (d *Dashboard) frame() []string {
+	d.mu.Lock()
+	s := d.summary
+	total := d.total
+	opts := d.opts
+	elapsed := time.Since(d.start)
+	lastMinute := len(d.recent)
+	errors := append([]string(nil), d.errors...)
+	d.mu.Unlock()
+
+	processed := s.Processed()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(processed) / elapsed.Seconds()
+	}
+
+	state := "running"
+	if pause.Paused() {
+		state = ansiYellow + ansiBold + "PAUSED" + ansiReset + " (Enter or SIGUSR2 resumes)"
+	}
+	lines := []string{
+		fmt.Sprintf("%sKBBI scraper%s  %s %s", ansiBold, ansiReset, state, formatDuration(elapsed)),
+		"",
+	}
+
+	if total > 0 {
+		done := float64(processed) / float64(total)
+		filled := int(done * barWidth)
+		eta := "-"
+		if rate > 0 {
+			eta = formatDuration(time.Duration(float64(total-processed) / rate * float64(time.Second)))
+		}
+		lines = append(lines,
+			fmt.Sprintf("Progress    [%s%s] %d/%d (%.1f%%)", strings.Repeat("#", filled), strings.Repeat(".", barWidth-filled), processed, total, done*100),
+			fmt.Sprintf("Throughput  %.2f words/s, %d in the last minute, ETA %s", rate, lastMinute, eta))
+	} else {
+		lines = append(lines,
+			fmt.Sprintf("Progress    %d words (streaming, total unknown)", processed),
+			fmt.Sprintf("Throughput  %.2f words/s, %d in the last minute", rate, lastMinute))
+	}
+
+	lines = append(lines,
+		fmt.Sprintf("Outcomes    %sdone %d%s  no result %d  skipped %d  %sfailed %d%s",
+			ansiGreen, s.Completed, ansiReset, s.NoResult, s.Skipped, ansiRed, s.Failed, ansiReset),
+		"")
+
+	lines = append(lines, d.providerLines(opts)...)
+	lines = append(lines, "")
+	if opts.Proxies != nil {
+		lines = append(lines, d.proxyLines(opts.Proxies)...)
+		lines = append(lines, "")
+	}
+	lines = append(lines, d.quotaLines(opts)...)
+	lines = append(lines, "", ansiBold+"Last errors"+ansiReset)
+	if len(errors) == 0 {
+		lines = append(lines, "  none")
+	}
+	for _, line := range errors {
+		lines = append(lines, ansiRed+"  "+line)
+	}
+
+	lines = append(lines, "", fmt.Sprintf("Details are logged to %s", d.logFile))
+	return lines
+}
+
+// providerLines merges the circuit state, the credit ledger and the
+// bandwidth meter by provider name.
+func (d *Dashboard) providerLines(opts kbbi.SearchOptions) []string {
+	lines := []string{ansiBold + "Providers" + ansiReset}
+
+	credits := map[string]proxy.ProviderUsage{}
+	if opts.Ledger != nil {
+		for _, usage := range opts.Ledger.Summary() {
+			credits[usage.Name] = usage
+		}
+	}
+
+	bandwidth := map[string]proxy.BandwidthUsage{}
+	var names []string
+	if meter := kbbi.BandwidthMeter(); meter != nil {
+		for _, usage := range meter.Summary() {
+			bandwidth[usage.Name] = usage
+			names = append(names, usage.Name)
+		}
+	}
+
+	circuits := map[string]proxy.ChainStatus{}
+	if opts.Chain != nil {
+		names = names[:0]
+		for _, status := range opts.Chain.Status() {
+			circuits[status.Name] = status
+			names = append(names, status.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		return append(lines, "  no requests yet")
+	}
+
+	for _, name := range names {
+		line := fmt.Sprintf("  %-12s", name)
+		if status, ok := circuits[name]; ok {
+			color := ansiGreen
+			switch status.State {
+			case proxy.BreakerOpen:
+				color = ansiRed
+			case proxy.BreakerHalfOpen:
+				color = ansiYellow
+			}
+			line += fmt.Sprintf(" %s%-9s%s failures=%-3d", color, status.State, ansiReset, status.Failures)
+		}
+		if usage, ok := credits[name]; ok {
+			line += fmt.Sprintf(" ok=%d failed=%d credits=%.0f", usage.Successes, usage.Failures, usage.Credits)
+			if usage.HasRemaining {
+				line += fmt.Sprintf(" remaining=%.0f", usage.RemainingCredits)
+			}
+		}
+		if usage, ok := bandwidth[name]; ok {
+			line += fmt.Sprintf(" requests=%d in=%s", usage.Requests, proxy.FormatBytes(usage.BytesIn))
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// proxyLines lists the healthy share of the proxy pool and the proxies
+// waiting out their cooldown.
+func (d *Dashboard) proxyLines(pool *proxy.Pool) []string {
+	lines := []string{ansiBold + "Proxies" + ansiReset}
+	lines = append(lines, fmt.Sprintf("  %d/%d healthy", pool.Healthy(), pool.Len()))
+
+	for _, status := range pool.Status() {
+		if !status.Healthy {
+			lines = append(lines, fmt.Sprintf("  %s%s%s ejected until %s, %d failures (%s)", ansiRed, status.URL, ansiReset, status.EjectedUntil.Format(time.TimeOnly), status.Failures, status.Reason))
+		}
+	}
+	return lines
+}
+
+func (d *Dashboard) quotaLines(opts kbbi.SearchOptions) []string {
+	lines := []string{ansiBold + "Quota" + ansiReset}
+
+	if used, limit := kbbi.DailyQuota(); limit > 0 {
+		lines = append(lines, fmt.Sprintf("  daily requests  %s", usageColor(float64(used), float64(limit), fmt.Sprintf("%d/%d", used, limit))))
+	} else {
+		lines = append(lines, "  daily requests  no cap")
+	}
+
+	if opts.Ledger != nil {
+		spent := opts.Ledger.Total()
+		if limit := opts.Ledger.Budget(); limit > 0 {
+			lines = append(lines, fmt.Sprintf("  est. credits    %s", usageColor(spent, limit, fmt.Sprintf("%.0f/%.0f", spent, limit))))
+		} else {
+			lines = append(lines, fmt.Sprintf("  est. credits    %.0f, no budget", spent))
+		}
+	}
+
+	if opts.Accounts != nil {
+		for _, status := range opts.Accounts.Status() {
+			line := fmt.Sprintf("  %-24s %d searches today", status.Email, status.Used)
+			if time.Now().Before(status.ParkedUntil) {
+				line += fmt.Sprintf(", %sparked until %s%s (%s)", ansiYellow, status.ParkedUntil.Format(time.TimeOnly), ansiReset, status.Reason)
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func usageColor(used, limit float64, text string) string {
+	switch {
+	case used >= limit:
+		return ansiRed + text + ansiReset
+	case used >= limit*0.8:
+		return ansiYellow + text + ansiReset
+	default:
+		return ansiCyan + text + ansiReset
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
+
+// truncate cuts line to width visible characters. Escape sequences are
+// kept, so colors are still reset after the cut.
+func truncate(line string, width int) string {
+	var b strings.Builder
+	visible := 0
+	escape := false
+	for _, r := range line {
+		if r == '\x1b' {
+			escape = true
+		}
+		if escape {
+			b.WriteRune(r)
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+				escape = false
+			}
+			continue
+		}
+		if visible < width {
+			b.WriteRune(r)
+			visible++
+		}
+	}
+	return b.String()
+}
@@ -34,13 +34,55 @@ CREATE TABLE IF NOT EXISTS lema (
     kata VARCHAR(255) NOT NULL,
     lema VARCHAR(255) NOT NULL,
     kelas_kata TINYTEXT,
-    keterangan TEXT
+    keterangan TEXT,
+    INDEX idx_lema_kata (kata)
 );
 
 CREATE TABLE IF NOT EXISTS words (
     id INT AUTO_INCREMENT PRIMARY KEY,
     kata VARCHAR(255) UNIQUE NOT NULL
-);`
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+    kata VARCHAR(255) COLLATE utf8mb4_bin NOT NULL PRIMARY KEY,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    last_provider VARCHAR(64),
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    started_at DATETIME NULL,
+    finished_at DATETIME NULL,
+    lease_owner VARCHAR(128),
+    lease_expires_at DATETIME NULL,
+    INDEX idx_jobs_status (status)
+) DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS no_results (
+    kata VARCHAR(255) COLLATE utf8mb4_bin NOT NULL PRIMARY KEY,
+    url VARCHAR(512) NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+) DEFAULT CHARSET = utf8mb4;`
+
+// migrations adds columns introduced after a table was first created,
+// since CREATE TABLE IF NOT EXISTS leaves existing tables alone.
+var migrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"jobs", "lease_owner", "VARCHAR(128)"},
+	{"jobs", "lease_expires_at", "DATETIME NULL"},
+}
+
+// indexes adds indexes introduced after a table was first created.
+var indexes = []struct {
+	table   string
+	name    string
+	columns string
+}{
+	{"lema", "idx_lema_kata", "kata"},
+}
 
 type Lema struct {
 	Id         int    `db:"id"`
@@ -84,9 +126,55 @@ func ConnectDB() (*sqlx.DB, error) {
 		return nil, fmt.Errorf("error creating schema: %w", err)
 	}
 
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("error migrating schema: %w", err)
+	}
+
 	return db, nil
 }
 
+func migrate(db *sqlx.DB) error {
+	for _, m := range migrations {
+		var exists bool
+		err := db.Get(&exists, `
+			SELECT EXISTS(
+				SELECT 1 FROM information_schema.COLUMNS
+				WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?
+			)`, m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("adding %s.%s: %w", m.table, m.column, err)
+		}
+	}
+
+	for _, index := range indexes {
+		var exists bool
+		err := db.Get(&exists, `
+			SELECT EXISTS(
+				SELECT 1 FROM information_schema.STATISTICS
+				WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?
+			)`, index.table, index.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		common.PrintInfo("Adding index %s to %s, this may take a while on a large table", index.name, index.table)
+		if _, err := db.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", index.name, index.table, index.columns)); err != nil {
+			return fmt.Errorf("adding index %s: %w", index.name, err)
+		}
+	}
+	return nil
+}
+
 func CloseDB(db *sqlx.DB) {
 	if err := db.Close(); err != nil {
 		common.PrintError("Failed to close database: %v", err)
@@ -123,11 +211,46 @@ func InsertLemas(db *sqlx.DB, lemas []Lema) error {
 	return nil
 }
 
-func ExistsLemaByKata(db *sqlx.DB, kata string) (bool, error) {
-	query := `SELECT EXISTS(SELECT 1 FROM lema WHERE kata = ?)`
-	var exists bool
-	err := db.Get(&exists, query, kata)
-	return exists, err
+// EachLemaKata streams the kata of every lema row to fn, once per row.
+// DISTINCT is left out because the table collation would fold words that
+// differ only in case.
+func EachLemaKata(db *sqlx.DB, fn func(string) error) error {
+	rows, err := db.Queryx("SELECT kata FROM lema")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kata string
+		if err := rows.Scan(&kata); err != nil {
+			return err
+		}
+		if err := fn(kata); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// EachLema streams every lema row to fn without loading the table.
+func EachLema(db *sqlx.DB, fn func(Lema) error) error {
+	rows, err := db.Queryx("SELECT id, kata, lema, COALESCE(kelas_kata, '') AS kelas_kata, COALESCE(keterangan, '') AS keterangan FROM lema ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l Lema
+		if err := rows.StructScan(&l); err != nil {
+			return err
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
 }
 
 func InsertWords(db *sqlx.DB, words []string) error {
@@ -137,8 +260,9 @@ func InsertWords(db *sqlx.DB, words []string) error {
 	}
 	defer tx.Rollback()
 
+	// A page crawled again after a resume repeats words already stored.
 	stmt, err := tx.Preparex(`
-		INSERT INTO words (kata)
+		INSERT IGNORE INTO words (kata)
 		VALUES (?)
 	`)
 	if err != nil {
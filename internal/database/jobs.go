@@ -0,0 +1,328 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Job statuses. A failed job is retried until it has used its attempts and
+// is then moved to the dead letter, where it stays until requeued.
+const (
+	JobPending    = "pending"
+	JobInProgress = "in-progress"
+	JobDone       = "done"
+	JobNoResult   = "no-result"
+	JobFailed     = "failed"
+	JobParseError = "parse-error"
+	JobDeadLetter = "dead-letter"
+)
+
+// JobStatuses lists every status in the order a job moves through them.
+var JobStatuses = []string{JobPending, JobInProgress, JobDone, JobNoResult, JobFailed, JobParseError, JobDeadLetter}
+
+const enqueueChunkSize = 500
+
+var ErrLeaseLost = errors.New("job lease was lost to another worker")
+
+type Job struct {
+	Kata           string         `db:"kata"`
+	Status         string         `db:"status"`
+	Attempts       int            `db:"attempts"`
+	LastError      sql.NullString `db:"last_error"`
+	LastProvider   sql.NullString `db:"last_provider"`
+	CreatedAt      time.Time      `db:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at"`
+	StartedAt      sql.NullTime   `db:"started_at"`
+	FinishedAt     sql.NullTime   `db:"finished_at"`
+	LeaseOwner     sql.NullString `db:"lease_owner"`
+	LeaseExpiresAt sql.NullTime   `db:"lease_expires_at"`
+}
+
+type JobCount struct {
+	Status string `db:"status"`
+	Count  int    `db:"count"`
+}
+
+// EnqueueJobs adds a pending job for every word that has none yet.
+func EnqueueJobs(db *sqlx.DB, words []string) error {
+	for start := 0; start < len(words); start += enqueueChunkSize {
+		end := min(start+enqueueChunkSize, len(words))
+		chunk := words[start:end]
+
+		query := "INSERT IGNORE INTO jobs (kata) VALUES " + strings.TrimSuffix(strings.Repeat("(?),", len(chunk)), ",")
+		args := make([]interface{}, len(chunk))
+		for i, word := range chunk {
+			args[i] = word
+		}
+
+		if _, err := db.Exec(query, args...); err != nil {
+			return fmt.Errorf("failed to enqueue jobs: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// SettleJobs gives the waiting jobs of words, which are known to be
+// finished already, their final status without claiming them.
+func SettleJobs(db *sqlx.DB, words []string, status string) error {
+	for start := 0; start < len(words); start += enqueueChunkSize {
+		end := min(start+enqueueChunkSize, len(words))
+
+		query, args, err := sqlx.In(`
+			UPDATE jobs SET status = ?, finished_at = NOW()
+			WHERE kata IN (?) AND status IN ('pending', 'failed')
+		`, status, words[start:end])
+		if err != nil {
+			return fmt.Errorf("failed to build settle query: %w", err)
+		}
+		if _, err := db.Exec(query, args...); err != nil {
+			return fmt.Errorf("failed to settle jobs: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// claimable matches the jobs a worker may take: never finished, failed
+// before, or in progress under a lease its owner stopped renewing.
+const claimable = `(status IN ('pending', 'failed') OR (status = 'in-progress' AND (lease_expires_at IS NULL OR lease_expires_at < NOW())))`
+
+// NewLeaseOwner returns an ID naming this process in job leases.
+func NewLeaseOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%04x", host, os.Getpid(), rand.Intn(1<<16))
+}
+
+// ClaimJob leases the job of kata to owner and counts the attempt. It
+// returns false when the job is finished, dead-lettered or leased by a
+// live worker, which makes it safe for several processes to work through
+// the same word list.
+func ClaimJob(db *sqlx.DB, kata, owner string, lease time.Duration) (bool, error) {
+	// MySQL applies the assignments left to right, so status has to come
+	// last for the others to see the old value.
+	seconds := int(lease.Seconds())
+	result, err := db.Exec(`
+		INSERT INTO jobs (kata, status, attempts, started_at, lease_owner, lease_expires_at)
+		VALUES (?, 'in-progress', 1, NOW(), ?, NOW() + INTERVAL ? SECOND)
+		ON DUPLICATE KEY UPDATE
+			attempts = IF(`+claimable+`, attempts + 1, attempts),
+			started_at = IF(`+claimable+`, NOW(), started_at),
+			lease_owner = IF(`+claimable+`, ?, lease_owner),
+			lease_expires_at = IF(`+claimable+`, NOW() + INTERVAL ? SECOND, lease_expires_at),
+			status = IF(`+claimable+`, 'in-progress', status)
+	`, kata, owner, seconds, owner, seconds)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim job %s: %w", kata, err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim job %s: %w", kata, err)
+	}
+	return affected > 0, nil
+}
+
+// LeaseJobs leases up to limit claimable jobs to owner in one transaction.
+// SKIP LOCKED lets concurrent processes lease disjoint batches without
+// waiting on each other; it needs MySQL 8.0 or MariaDB 10.6.
+func LeaseJobs(db *sqlx.DB, owner string, limit int, lease time.Duration) ([]string, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var words []string
+	err = tx.Select(&words, `
+		SELECT kata FROM jobs
+		WHERE `+claimable+`
+		LIMIT ?
+		FOR UPDATE SKIP LOCKED
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select jobs: %w", err)
+	}
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In(`
+		UPDATE jobs
+		SET status = 'in-progress', attempts = attempts + 1, started_at = NOW(),
+			lease_owner = ?, lease_expires_at = NOW() + INTERVAL ? SECOND
+		WHERE kata IN (?)
+	`, owner, int(lease.Seconds()), words)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build lease query: %w", err)
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return nil, fmt.Errorf("failed to lease jobs: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return words, nil
+}
+
+// ExtendLeases is the heartbeat of owner: it pushes back the expiry of
+// every job it still holds.
+func ExtendLeases(db *sqlx.DB, owner string, lease time.Duration) error {
+	_, err := db.Exec(`
+		UPDATE jobs SET lease_expires_at = NOW() + INTERVAL ? SECOND
+		WHERE lease_owner = ? AND status = 'in-progress'
+	`, int(lease.Seconds()), owner)
+	if err != nil {
+		return fmt.Errorf("failed to extend leases: %w", err)
+	}
+	return nil
+}
+
+// ReleaseLeases hands the jobs owner leased but never started back to the
+// queue, without counting the attempt.
+func ReleaseLeases(db *sqlx.DB, owner string) (int64, error) {
+	result, err := db.Exec(`
+		UPDATE jobs
+		SET status = 'pending', attempts = GREATEST(attempts - 1, 0), lease_expires_at = NULL
+		WHERE lease_owner = ? AND status = 'in-progress'
+	`, owner)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release leases: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// FinishJob records the final status of a job leased to owner. It returns
+// ErrLeaseLost when the lease expired and another worker took the job.
+func FinishJob(db *sqlx.DB, kata, owner, status, provider string, jobErr error) error {
+	result, err := db.Exec(`
+		UPDATE jobs
+		SET status = ?, last_provider = ?, last_error = ?, finished_at = NOW(), lease_expires_at = NULL
+		WHERE kata = ? AND lease_owner = ?
+	`, status, nullString(provider), errorString(jobErr), kata, owner)
+	if err != nil {
+		return fmt.Errorf("failed to finish job %s: %w", kata, err)
+	}
+	return checkLease(result, kata)
+}
+
+// FailJob records a failed attempt and dead-letters the job once it has
+// used maxAttempts.
+func FailJob(db *sqlx.DB, kata, owner, provider string, jobErr error, maxAttempts int) error {
+	result, err := db.Exec(`
+		UPDATE jobs
+		SET status = IF(attempts >= ?, 'dead-letter', 'failed'),
+			last_provider = ?, last_error = ?, finished_at = NOW(), lease_expires_at = NULL
+		WHERE kata = ? AND lease_owner = ?
+	`, maxAttempts, nullString(provider), errorString(jobErr), kata, owner)
+	if err != nil {
+		return fmt.Errorf("failed to record failure of job %s: %w", kata, err)
+	}
+	return checkLease(result, kata)
+}
+
+// ReleaseJob puts a claimed job back to pending without counting the
+// attempt, for runs that stop for reasons unrelated to the word.
+func ReleaseJob(db *sqlx.DB, kata, owner string) error {
+	_, err := db.Exec(`
+		UPDATE jobs
+		SET status = 'pending', attempts = GREATEST(attempts - 1, 0), lease_expires_at = NULL
+		WHERE kata = ? AND lease_owner = ? AND status = 'in-progress'
+	`, kata, owner)
+	if err != nil {
+		return fmt.Errorf("failed to release job %s: %w", kata, err)
+	}
+	return nil
+}
+
+func checkLease(result sql.Result, kata string) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("%w: %s", ErrLeaseLost, kata)
+	}
+	return nil
+}
+
+// CountOpenJobs counts the jobs a worker could still claim.
+func CountOpenJobs(db *sqlx.DB) (int, error) {
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM jobs WHERE "+claimable)
+	return count, err
+}
+
+func CountJobs(db *sqlx.DB) ([]JobCount, error) {
+	var counts []JobCount
+	err := db.Select(&counts, "SELECT status, COUNT(*) AS count FROM jobs GROUP BY status")
+	return counts, err
+}
+
+func ListJobs(db *sqlx.DB, status string, limit int) ([]Job, error) {
+	var jobs []Job
+	err := db.Select(&jobs, "SELECT * FROM jobs WHERE status = ? ORDER BY updated_at DESC LIMIT ?", status, limit)
+	return jobs, err
+}
+
+// RequeueJobs moves the jobs with status back to pending with a fresh
+// attempt count. With no words every job with status is requeued.
+func RequeueJobs(db *sqlx.DB, status string, words []string) (int64, error) {
+	query := "UPDATE jobs SET status = 'pending', attempts = 0, last_error = NULL WHERE status = ?"
+	args := []interface{}{status}
+
+	if len(words) > 0 {
+		in, inArgs, err := sqlx.In(" AND kata IN (?)", words)
+		if err != nil {
+			return 0, fmt.Errorf("failed to build requeue query: %w", err)
+		}
+		query += in
+		args = append(args, inArgs...)
+	}
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue jobs: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func errorString(err error) sql.NullString {
+	if err == nil {
+		return sql.NullString{}
+	}
+	return nullString(err.Error())
+}
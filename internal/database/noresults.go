@@ -0,0 +1,71 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type NoResult struct {
+	Kata string `db:"kata"`
+	Url  string `db:"url"`
+}
+
+// InsertNoResults records words KBBI has no entry for. Words already
+// recorded are left alone.
+func InsertNoResults(db *sqlx.DB, results []NoResult) error {
+	for start := 0; start < len(results); start += enqueueChunkSize {
+		end := min(start+enqueueChunkSize, len(results))
+		chunk := results[start:end]
+
+		query := "INSERT IGNORE INTO no_results (kata, url) VALUES " + strings.TrimSuffix(strings.Repeat("(?, ?),", len(chunk)), ",")
+		args := make([]interface{}, 0, 2*len(chunk))
+		for _, result := range chunk {
+			args = append(args, result.Kata, result.Url)
+		}
+
+		if _, err := db.Exec(query, args...); err != nil {
+			return fmt.Errorf("failed to insert no-result words: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// EachNoResult streams every no-result word to fn.
+func EachNoResult(db *sqlx.DB, fn func(NoResult) error) error {
+	rows, err := db.Queryx("SELECT kata, url FROM no_results")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result NoResult
+		if err := rows.StructScan(&result); err != nil {
+			return err
+		}
+		if err := fn(result); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
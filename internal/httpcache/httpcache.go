@@ -0,0 +1,276 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package httpcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"kbbi-scraper/internal/common"
+)
+
+const (
+	DEFAULT_CACHE_DIR = ".cache/http"
+
+	// HEADER_CACHE marks responses served by the cache, so callers do not
+	// bill them to a provider.
+	HEADER_CACHE = "X-Kbbi-Cache"
+)
+
+type Mode string
+
+const (
+	// ModeNormal serves fresh entries and revalidates stale ones.
+	ModeNormal Mode = "normal"
+	// ModeCacheOnly never touches the network; misses are errors.
+	ModeCacheOnly Mode = "cache-only"
+	// ModeRefresh always asks the server, revalidating when possible.
+	ModeRefresh Mode = "refresh"
+	// ModeBypass neither reads nor writes the cache.
+	ModeBypass Mode = "bypass"
+)
+
+var ErrCacheMiss = errors.New("not in HTTP cache")
+
+type entry struct {
+	URL      string      `json:"url"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+	StoredAt time.Time   `json:"stored_at"`
+}
+
+// Cache stores GET responses on disk keyed by their canonical KBBI URL and
+// login session, so the same page is found whichever proxy provider fetched
+// it but never served to another session.
+type Cache struct {
+	Dir  string
+	TTL  time.Duration
+	Mode Mode
+
+	// Cacheable selects the pages worth caching.
+	Cacheable func(u *url.URL) bool
+	// Storable rejects responses that must not be cached, such as the
+	// daily limit page or a provider error body served with status 200.
+	Storable func(resp *http.Response, body []byte) bool
+	// Session returns the login session a request is made with, "" when
+	// it is logged out.
+	Session func(req *http.Request) string
+}
+
+// Load reads HTTP_CACHE_MODE, HTTP_CACHE_DIR and HTTP_CACHE_TTL. It returns
+// nil when the mode is bypass, which is the default.
+func Load() (*Cache, error) {
+	mode := Mode(common.GetEnvString("HTTP_CACHE_MODE", string(ModeBypass)))
+	switch mode {
+	case ModeBypass:
+		return nil, nil
+	case ModeNormal, ModeCacheOnly, ModeRefresh:
+	default:
+		return nil, fmt.Errorf("unknown HTTP_CACHE_MODE %q", mode)
+	}
+
+	c := &Cache{
+		Dir:  common.GetEnvString("HTTP_CACHE_DIR", DEFAULT_CACHE_DIR),
+		TTL:  common.GetEnvDuration("HTTP_CACHE_TTL", 30*24*time.Hour),
+		Mode: mode,
+	}
+
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+
+	return c, nil
+}
+
+// Transport wraps next with the cache.
+func (c *Cache) Transport(next http.RoundTripper) http.RoundTripper {
+	return &transport{cache: c, next: next}
+}
+
+type transport struct {
+	cache *Cache
+	next  http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.cache
+	if req.Method != http.MethodGet || c.Mode == ModeBypass {
+		return t.next.RoundTrip(req)
+	}
+
+	canonical := common.CanonicalKBBIURL(req.URL)
+	if canonical == nil || (c.Cacheable != nil && !c.Cacheable(canonical)) {
+		return t.next.RoundTrip(req)
+	}
+
+	key := canonical.String()
+	if c.Session != nil {
+		if session := c.Session(req); session != "" {
+			sum := sha256.Sum256([]byte(session))
+			key += " session=" + hex.EncodeToString(sum[:8])
+		}
+	}
+	cached := c.load(key)
+
+	switch c.Mode {
+	case ModeCacheOnly:
+		if cached == nil {
+			return nil, fmt.Errorf("%s: %w", key, ErrCacheMiss)
+		}
+		return cached.response(req, "HIT"), nil
+	case ModeNormal:
+		if cached != nil && time.Since(cached.StoredAt) < c.TTL {
+			return cached.response(req, "HIT"), nil
+		}
+	}
+
+	if cached != nil {
+		req = req.Clone(req.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+		cached.StoredAt = time.Now()
+		c.save(key, cached)
+		return cached.response(req, "REVALIDATED"), nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	if c.Storable == nil || c.Storable(resp, body) {
+		header := resp.Header.Clone()
+		header.Del("Set-Cookie")
+		c.save(key, &entry{
+			URL:      key,
+			Status:   resp.StatusCode,
+			Header:   header,
+			Body:     body,
+			StoredAt: time.Now(),
+		})
+	}
+
+	return resp, nil
+}
+
+func (c *Cache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.Dir, name[:2], name+".json")
+}
+
+func (c *Cache) load(key string) *entry {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil
+	}
+
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil || e.URL != key {
+		return nil
+	}
+	return &e
+}
+
+func (c *Cache) save(key string, e *entry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		common.LogError("Error marshaling cache entry", err)
+		return
+	}
+
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		common.LogError("Error creating cache directory", err)
+		return
+	}
+
+	// Write to a temporary file first so concurrent readers never see a
+	// half written entry.
+	tmp, err := os.CreateTemp(filepath.Dir(path), "entry-*.tmp")
+	if err != nil {
+		common.LogError("Error writing cache entry", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		common.LogError("Error writing cache entry", err)
+	}
+}
+
+func (e *entry) response(req *http.Request, state string) *http.Response {
+	header := e.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set(HEADER_CACHE, state)
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// IsCached reports whether resp headers come from the cache.
+func IsCached(header http.Header) bool {
+	return header != nil && header.Get(HEADER_CACHE) != ""
+}
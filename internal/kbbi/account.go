@@ -0,0 +1,319 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package kbbi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"kbbi-scraper/internal/common"
+)
+
+const ACCOUNT_USAGE_FILE = "account_usage.json"
+
+// bannedParkDuration keeps a banned account out of rotation long enough
+// for someone to look at it; it is not retried within a run.
+const bannedParkDuration = 30 * 24 * time.Hour
+
+// usageSaveInterval batches the usage file writes of busy runs. Parking an
+// account is written at once.
+const usageSaveInterval = 10 * time.Second
+
+var ErrNoAccountAvailable = fmt.Errorf("no healthy KBBI account left: %w", ErrLimitReached)
+
+type AccountConfig struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type Account struct {
+	Email       string
+	Session     *SessionManager
+	used        int
+	parkedUntil time.Time
+	reason      string
+	lastUsed    time.Time
+	busy        bool
+}
+
+type AccountStatus struct {
+	Email       string
+	Used        int
+	ParkedUntil time.Time
+	Reason      string
+}
+
+type accountUsage struct {
+	Date   string                        `json:"date"`
+	Counts map[string]int                `json:"counts"`
+	Parked map[string]accountUsageParked `json:"parked"`
+}
+
+type accountUsageParked struct {
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+// AccountPool rotates searches over several KBBI accounts. Each account is
+// lent to one search at a time, so workers never share a daily quota.
+// Usage is counted per account per day and accounts that hit the daily
+// limit or get banned are parked until they are usable again.
+type AccountPool struct {
+	mu         sync.Mutex
+	free       *sync.Cond
+	accounts   []*Account
+	dailyLimit int
+	day        string
+	dirty      bool
+	savedAt    time.Time
+}
+
+// LoadAccountPool reads the accounts from KBBI_ACCOUNTS_FILE (a JSON list of
+// {"email", "password"}) or KBBI_ACCOUNTS ("email:password,..."). It returns
+// nil when no pool is configured.
+func LoadAccountPool() (*AccountPool, error) {
+	var configs []AccountConfig
+
+	if file := os.Getenv("KBBI_ACCOUNTS_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading accounts file: %w", err)
+		}
+		if err := json.Unmarshal(data, &configs); err != nil {
+			return nil, fmt.Errorf("error parsing accounts file: %w", err)
+		}
+	}
+
+	for _, entry := range common.GetEnvList("KBBI_ACCOUNTS") {
+		email, password, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid KBBI_ACCOUNTS entry for %q", email)
+		}
+		configs = append(configs, AccountConfig{Email: email, Password: password})
+	}
+
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	return NewAccountPool(configs, common.GetEnvInt("ACCOUNT_DAILY_LIMIT", 0)), nil
+}
+
+func NewAccountPool(configs []AccountConfig, dailyLimit int) *AccountPool {
+	p := &AccountPool{
+		dailyLimit: dailyLimit,
+		day:        today(),
+	}
+	p.free = sync.NewCond(&p.mu)
+
+	for _, config := range configs {
+		p.accounts = append(p.accounts, &Account{
+			Email:   config.Email,
+			Session: newSessionManager(config.Email, config.Password, common.SessionFileFor(config.Email)),
+		})
+	}
+
+	p.loadUsage()
+	return p
+}
+
+func (p *AccountPool) Len() int {
+	return len(p.accounts)
+}
+
+// Acquire lends out the least recently used healthy account that is not
+// in use, waiting for one to be released when all healthy accounts are
+// busy. The account must be given back with Release.
+func (p *AccountPool) Acquire() (*Account, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		p.rollDay()
+
+		now := time.Now()
+		var chosen *Account
+		healthy := 0
+		for _, acc := range p.accounts {
+			if now.Before(acc.parkedUntil) {
+				continue
+			}
+			if p.dailyLimit > 0 && acc.used >= p.dailyLimit {
+				acc.parkedUntil = nextMidnight()
+				acc.reason = "daily quota used"
+				continue
+			}
+			healthy++
+			if !acc.busy && (chosen == nil || acc.lastUsed.Before(chosen.lastUsed)) {
+				chosen = acc
+			}
+		}
+
+		if healthy == 0 {
+			return nil, ErrNoAccountAvailable
+		}
+		if chosen != nil {
+			chosen.busy = true
+			chosen.lastUsed = now
+			return chosen, nil
+		}
+
+		p.free.Wait()
+	}
+}
+
+// Release records one search made with acc and parks the account when err
+// says KBBI will not serve it any more today.
+func (p *AccountPool) Release(acc *Account, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.free.Broadcast()
+
+	acc.busy = false
+	acc.used++
+	p.dirty = true
+
+	switch {
+	case errors.Is(err, ErrAccountBanned):
+		acc.parkedUntil = time.Now().Add(bannedParkDuration)
+		acc.reason = "banned"
+		common.PrintError("Account %s is banned, removing it from rotation", acc.Email)
+	case errors.Is(err, ErrLimitReached):
+		acc.parkedUntil = nextMidnight()
+		acc.reason = "daily limit reached"
+		common.PrintWarning("Account %s reached the daily limit after %d searches, rotating", acc.Email, acc.used)
+	default:
+		if time.Since(p.savedAt) < usageSaveInterval {
+			return
+		}
+	}
+
+	p.saveUsage()
+}
+
+// Flush writes usage not saved yet, at the end of a run.
+func (p *AccountPool) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.dirty {
+		p.saveUsage()
+	}
+}
+
+func (p *AccountPool) Status() []AccountStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := make([]AccountStatus, 0, len(p.accounts))
+	for _, acc := range p.accounts {
+		status = append(status, AccountStatus{
+			Email:       acc.Email,
+			Used:        acc.used,
+			ParkedUntil: acc.parkedUntil,
+			Reason:      acc.reason,
+		})
+	}
+	return status
+}
+
+func (p *AccountPool) rollDay() {
+	if day := today(); day != p.day {
+		p.day = day
+		for _, acc := range p.accounts {
+			acc.used = 0
+			if acc.reason != "banned" {
+				acc.parkedUntil = time.Time{}
+				acc.reason = ""
+			}
+		}
+	}
+}
+
+func (p *AccountPool) loadUsage() {
+	data, err := os.ReadFile(ACCOUNT_USAGE_FILE)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading account usage file: %v", err)
+		}
+		return
+	}
+
+	var usage accountUsage
+	if err := json.Unmarshal(data, &usage); err != nil {
+		log.Printf("Error unmarshaling account usage: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, acc := range p.accounts {
+		if usage.Date == p.day {
+			acc.used = usage.Counts[acc.Email]
+		}
+		if parked, ok := usage.Parked[acc.Email]; ok && now.Before(parked.Until) {
+			acc.parkedUntil = parked.Until
+			acc.reason = parked.Reason
+		}
+	}
+}
+
+func (p *AccountPool) saveUsage() {
+	p.dirty = false
+	p.savedAt = time.Now()
+
+	usage := accountUsage{
+		Date:   p.day,
+		Counts: map[string]int{},
+		Parked: map[string]accountUsageParked{},
+	}
+
+	for _, acc := range p.accounts {
+		usage.Counts[acc.Email] = acc.used
+		if !acc.parkedUntil.IsZero() {
+			usage.Parked[acc.Email] = accountUsageParked{
+				Until:  acc.parkedUntil,
+				Reason: acc.reason,
+			}
+		}
+	}
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		log.Printf("Error marshaling account usage: %v", err)
+		return
+	}
+
+	if err := os.WriteFile(ACCOUNT_USAGE_FILE, data, 0644); err != nil {
+		log.Printf("Error saving account usage: %v", err)
+	}
+}
+
+func today() string {
+	return time.Now().Format("2006-01-02")
+}
+
+func nextMidnight() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+}
@@ -0,0 +1,172 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package kbbi
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/proxy"
+
+	"github.com/andybalholm/brotli"
+)
+
+var ErrResponseTooLarge = errors.New("response exceeds the size limit")
+
+var bandwidth *proxy.Meter
+
+// SetBandwidthMeter counts the bytes every collector moves, per provider.
+func SetBandwidthMeter(m *proxy.Meter) {
+	bandwidth = m
+}
+
+func BandwidthMeter() *proxy.Meter {
+	return bandwidth
+}
+
+// meteredTransport asks for compressed responses, decodes them and counts
+// the bytes each request moves over the wire. It sits right above the HTTP
+// transport so cache hits and replayed responses are not counted.
+type meteredTransport struct {
+	next     http.RoundTripper
+	provider string
+	compress bool
+	maxBytes int64
+}
+
+func (t *meteredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.compress && req.Header.Get("Accept-Encoding") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	}
+
+	out := requestSize(req)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.record(req, 0, out)
+		return nil, err
+	}
+
+	in := headerSize(resp.Header)
+	if t.maxBytes > 0 && resp.ContentLength > t.maxBytes {
+		resp.Body.Close()
+		t.record(req, in, out)
+		return nil, fmt.Errorf("%w: %s announced %s", ErrResponseTooLarge, req.URL, proxy.FormatBytes(resp.ContentLength))
+	}
+
+	counter := &countingReader{r: resp.Body, limit: t.maxBytes}
+	body, decoded, err := decodeBody(resp.Header.Get("Content-Encoding"), counter)
+	var data []byte
+	if err == nil {
+		if decoded {
+			// The limit holds for the decoded page as well, so a small
+			// compressed body cannot expand without bound.
+			body = &countingReader{r: body, limit: t.maxBytes}
+		}
+		data, err = io.ReadAll(body)
+	}
+	resp.Body.Close()
+	t.record(req, in+counter.n, out)
+
+	if err != nil {
+		if errors.Is(err, ErrResponseTooLarge) {
+			return nil, fmt.Errorf("%w: %s sent more than %s", ErrResponseTooLarge, req.URL, proxy.FormatBytes(t.maxBytes))
+		}
+		return nil, fmt.Errorf("error reading response of %s: %w", req.URL, err)
+	}
+
+	if decoded {
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.Uncompressed = true
+	}
+	resp.ContentLength = int64(len(data))
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+
+	return resp, nil
+}
+
+func (t *meteredTransport) record(req *http.Request, in, out int64) {
+	bandwidth.Record(t.provider, in, out)
+	common.LogInfo(fmt.Sprintf("Bandwidth %s %s: in=%d out=%d", t.provider, req.URL.Redacted(), in, out))
+}
+
+// decodeBody wraps r in the decoder for encoding. It reports false when the
+// body was not compressed.
+func decodeBody(encoding string, r io.Reader) (io.Reader, bool, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "":
+		return r, false, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, false, fmt.Errorf("error decoding gzip body: %w", err)
+		}
+		return zr, true, nil
+	case "deflate":
+		return flate.NewReader(r), true, nil
+	case "br":
+		return brotli.NewReader(r), true, nil
+	default:
+		return nil, false, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// countingReader counts the bytes read through it and fails once more
+// than limit bytes arrive.
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.limit > 0 && c.n > c.limit {
+		return n, ErrResponseTooLarge
+	}
+	return n, err
+}
+
+// requestSize estimates the bytes of the request line, headers and body.
+func requestSize(req *http.Request) int64 {
+	size := int64(len(req.Method) + len(req.URL.RequestURI()) + len(" HTTP/1.1\r\n"))
+	size += headerSize(req.Header) + int64(len("Host: \r\n")+len(req.Host))
+	if req.ContentLength > 0 {
+		size += req.ContentLength
+	}
+	return size
+}
+
+func headerSize(header http.Header) int64 {
+	var size int64
+	for key, values := range header {
+		for _, value := range values {
+			size += int64(len(key) + len(value) + len(": \r\n"))
+		}
+	}
+	return size + 2
+}
@@ -21,51 +21,58 @@ import (
 	"fmt"
 	"kbbi-scraper/internal/common"
 	"kbbi-scraper/internal/kbbi"
+	"kbbi-scraper/internal/pause"
+	"kbbi-scraper/internal/proxy"
 	"sync"
 
 	"github.com/gocolly/colly/v2"
 	"github.com/jmoiron/sqlx"
 )
 
-func GetWordList(db *sqlx.DB, email string, password string, concurrency int) error {
+func GetWordList(db *sqlx.DB, session *kbbi.SessionManager, concurrency int) error {
 	c := colly.NewCollector(
 		colly.AllowURLRevisit(),
 		colly.UserAgent("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"),
 	)
 
-	_, err := kbbi.LoginKBBI(email, password)
+	cookie, err := session.Cookie()
 	if err != nil {
 		return err
 	}
+	kbbi.UseTransport(c, nil, proxy.DIRECT)
 
 	progress := common.LoadProgress()
-	startLetter := 'A'
-
-	if progress.CurrentLetter != "" {
-		startLetter = rune(progress.CurrentLetter[0])
-	}
 
 	var wg sync.WaitGroup
 	semaphore := make(chan struct{}, concurrency)
 	errChan := make(chan error, 26)
 
-	for letter := startLetter; letter <= 'Z'; letter++ {
+	for letter := 'A'; letter <= 'Z'; letter++ {
+		startPage := progress.Letters[string(letter)]
+		if startPage == common.LETTER_FINISHED {
+			continue
+		}
+		if startPage < 1 {
+			startPage = 1
+		}
+
 		wg.Add(1)
-		go func(letter rune) {
+		go func(letter rune, startPage int) {
 			defer wg.Done()
 			semaphore <- struct{}{}
 			defer func() { <-semaphore }()
 
-			startPage := 1
-			if string(letter) == progress.CurrentLetter {
-				startPage = progress.CurrentPage
-			}
+			// Clone keeps the transport but not the callbacks, so the
+			// headers and cookie are set on every clone.
+			lc := c.Clone()
+			kbbi.SetHeaders(lc, session.HeaderProfile())
+			kbbi.SetSessionCookie(lc, cookie)
 
-			err := processLetter(c.Clone(), db, letter, startPage)
+			err := processLetter(lc, db, letter, startPage)
 			if err != nil {
 				errChan <- fmt.Errorf("error processing letter %c: %v", letter, err)
 			}
-		}(letter)
+		}(letter, startPage)
 	}
 
 	go func() {
@@ -83,19 +90,22 @@ func GetWordList(db *sqlx.DB, email string, password string, concurrency int) er
 }
 
 func processLetter(c *colly.Collector, db *sqlx.DB, letter rune, startPage int) error {
+	crawler := kbbi.NewAlphabetCrawler(c)
 	currentPage := startPage
 
 	for {
-		isLastPage, err := kbbi.GetWordListByAlphabet(c, db, string(letter), currentPage)
+		// The page is saved before the wait, so a paused crawl can also be
+		// stopped and picked up from there.
+		common.SaveLetterProgress(string(letter), currentPage)
+		pause.Wait()
+
+		isLastPage, err := crawler.GetWordListByAlphabet(db, string(letter), currentPage)
 		if err != nil {
-			common.SaveProgress(common.Progress{
-				CurrentLetter: string(letter),
-				CurrentPage:   currentPage,
-			})
 			return err
 		}
 
 		if isLastPage {
+			common.SaveLetterProgress(string(letter), common.LETTER_FINISHED)
 			break
 		}
 
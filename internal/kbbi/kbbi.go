@@ -18,24 +18,22 @@
 package kbbi
 
 import (
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"kbbi-scraper/internal/common"
 	"kbbi-scraper/internal/database"
+	"kbbi-scraper/internal/httpcache"
+	"kbbi-scraper/internal/proxy"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/gocolly/colly/v2"
-	"github.com/gocolly/colly/v2/proxy"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -56,6 +54,21 @@ type Arti struct {
 	Keterangan string `json:"keterangan"`
 }
 
+type SearchResult struct {
+	Entries  []ResponseSearch
+	Provider string
+}
+
+type SearchOptions struct {
+	OptionProxy string
+	Provider    proxy.Provider
+	Session     *SessionManager
+	Accounts    *AccountPool
+	Proxies     *proxy.Pool
+	Chain       *proxy.Chain
+	Ledger      *proxy.Ledger
+}
+
 type LoginResult struct {
 	Cookie   string
 	IsBanned bool
@@ -66,6 +79,20 @@ func checkFrasaNotFound(e *goquery.Selection) bool {
 	return strings.Contains(html, "tidak ditemukan")
 }
 
+// checkLoggedOut reports whether the page offers the login link, which
+// KBBI only shows to anonymous visitors.
+func checkLoggedOut(e *goquery.Selection) bool {
+	return e.Find("a[href*='/Account/Login']").Length() > 0
+}
+
+func isLoginURL(u *url.URL) bool {
+	return strings.HasPrefix(strings.ToLower(u.Path), "/account/login")
+}
+
+func isBannedURL(u *url.URL) bool {
+	return strings.HasPrefix(strings.ToLower(u.Path), "/account/banned")
+}
+
 func checkBatasHarian(e *goquery.Selection) bool {
 	html, _ := e.Find("h1:contains('Batas Sehari')").Html()
 	return strings.Contains(html, "Batas Sehari")
@@ -161,13 +188,24 @@ func extractKataTidakBaku(e *goquery.Selection) string {
 }
 
 func LoginKBBI(email, password string) (*LoginResult, error) {
+	return loginKBBI(email, password, common.RandomHeaderProfile(), nil)
+}
+
+// loginKBBI logs in through proxyFunc, or directly when it is nil.
+func loginKBBI(email, password string, profile common.HeaderProfile, proxyFunc colly.ProxyFunc) (*LoginResult, error) {
 	c := colly.NewCollector(
 		colly.AllowURLRevisit(),
 		colly.UserAgent("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"),
 	)
+	SetHeaders(c, profile)
 
 	loginResult := &LoginResult{}
 	var token string
+	if proxyFunc != nil {
+		UseTransport(c, proxyFunc, "residential")
+	} else {
+		UseTransport(c, nil, proxy.DIRECT)
+	}
 
 	c.OnHTML("form input[name=__RequestVerificationToken]", func(e *colly.HTMLElement) {
 		token = e.Attr("value")
@@ -179,13 +217,13 @@ func LoginKBBI(email, password string) (*LoginResult, error) {
 		}
 
 		for _, cookie := range c.Cookies(r.Request.URL.String()) {
-			if cookie.Name == ".AspNet.ApplicationCookie" {
+			if cookie.Name == KBBI_COOKIE_NAME {
 				loginResult.Cookie = cookie.Value
 				break
 			}
 		}
 
-		loginResult.IsBanned = r.Request.URL.String() == KBBI_BANNED_URL
+		loginResult.IsBanned = isBannedURL(r.Request.URL)
 	})
 
 	if err := c.Visit(KBBI_LOGIN_URL); err != nil {
@@ -207,284 +245,539 @@ func LoginKBBI(email, password string) (*LoginResult, error) {
 		return nil, fmt.Errorf("login request failed: %w", err)
 	}
 
-	if loginResult.Cookie == "" {
-		return nil, fmt.Errorf("could not find login cookie")
+	if loginResult.IsBanned {
+		return loginResult, ErrAccountBanned
 	}
 
-	if loginResult.IsBanned {
-		return nil, fmt.Errorf("account is banned")
+	if loginResult.Cookie == "" {
+		return nil, fmt.Errorf("could not find login cookie")
 	}
 
 	return loginResult, nil
 }
 
-func GetWordListByAlphabet(c *colly.Collector, db *sqlx.DB, letter string, startPage int) (bool, error) {
-	var globalErr error
-	baseURL, err := url.Parse(KBBI_WORDLIST_URL)
-	if err != nil {
-		return false, err
-	}
+// AlphabetCrawler fetches the alphabet word list one page at a time. Its
+// handlers are registered on the collector once, so a crawler is made per
+// collector and its pages are fetched one after another.
+type AlphabetCrawler struct {
+	c    *colly.Collector
+	page alphabetPage
+}
 
-	params := url.Values{}
-	params.Add("masukan", letter)
-	params.Add("masukanLengkap", letter)
-	params.Add("page", strconv.Itoa(startPage))
-	baseURL.RawQuery = params.Encode()
+// alphabetPage is what the handlers read from the page being fetched.
+type alphabetPage struct {
+	words       []string
+	currentPage int
+	totalPages  int
+	hasNext     bool
+	recognised  bool
+	err         error
+}
 
-	fmt.Println(baseURL.String())
+func NewAlphabetCrawler(c *colly.Collector) *AlphabetCrawler {
+	a := &AlphabetCrawler{c: c}
 
-	var totalPages int
-	var words []string
-	currentPage := startPage
-	isLastPage := false
+	c.OnError(func(r *colly.Response, err error) {
+		a.page.err = newResponseError(r, err)
+	})
 
 	c.OnHTML("#currentPageId", func(e *colly.HTMLElement) {
+		a.page.recognised = true
 		parts := strings.Split(e.Text, "/")
 		if len(parts) == 2 {
-			totalPages, _ = strconv.Atoi(strings.TrimSpace(parts[1]))
-			currentPage, _ = strconv.Atoi(strings.TrimSpace(parts[0]))
-			isLastPage = currentPage == totalPages
+			a.page.currentPage, _ = strconv.Atoi(strings.TrimSpace(parts[0]))
+			a.page.totalPages, _ = strconv.Atoi(strings.TrimSpace(parts[1]))
 		}
 	})
 
 	c.OnHTML(".row .col-md-3", func(e *colly.HTMLElement) {
+		a.page.recognised = true
 		wordHTML := e.DOM.Find("a")
 		wordHTML.Find("sup").Remove()
-		word := strings.TrimSpace(wordHTML.Text())
-		words = append(words, word)
-		fmt.Printf("Letter %s, Page %d: %s\n", letter, currentPage, word)
+		a.page.words = append(a.page.words, strings.TrimSpace(wordHTML.Text()))
 	})
 
-	c.OnHTML(".row", func(e *colly.HTMLElement) {
-		nextPage := e.ChildAttr("a[title='Ke halaman berikutnya']", "href")
-		if nextPage != "" {
-			currentPage++
-			nextURL := e.Request.AbsoluteURL(nextPage)
-			fmt.Printf("Moving to next page for letter %s: %s\n", letter, nextURL)
-			common.SaveProgress(common.Progress{
-				CurrentLetter: letter,
-				CurrentPage:   currentPage,
-			})
-			e.Request.Visit(nextURL)
-		} else {
-			isLastPage = true
-		}
+	c.OnHTML(".row a[title='Ke halaman berikutnya']", func(e *colly.HTMLElement) {
+		a.page.hasNext = true
 	})
 
-	err = c.Visit(baseURL.String())
+	return a
+}
+
+// GetWordListByAlphabet fetches one page of the words starting with letter,
+// retrying only that page, and stores its words. It reports whether the
+// page was the last one.
+func (a *AlphabetCrawler) GetWordListByAlphabet(db *sqlx.DB, letter string, page int) (bool, error) {
+	baseURL, err := url.Parse(KBBI_WORDLIST_URL)
 	if err != nil {
 		return false, err
 	}
 
-	c.OnScraped(func(r *colly.Response) {
-		globalErr = database.InsertWords(db, words)
-		fmt.Printf("Finished scraping words for letter %s. Total pages: %d\n", letter, totalPages)
+	params := url.Values{}
+	params.Add("masukan", letter)
+	params.Add("masukanLengkap", letter)
+	params.Add("page", strconv.Itoa(page))
+	baseURL.RawQuery = params.Encode()
+
+	common.PrintInfo("Fetching %s", baseURL.String())
+
+	err = GetRetryPolicy().Do(fmt.Sprintf("letter %s page %d", letter, page), func(attempt int) error {
+		a.page = alphabetPage{currentPage: page}
+		if err := a.c.Visit(baseURL.String()); err != nil {
+			if a.page.err != nil {
+				return a.page.err
+			}
+			return err
+		}
+		if !a.page.recognised {
+			return fmt.Errorf("%w: %s", ErrParseFailed, baseURL.String())
+		}
+		return nil
 	})
+	if err != nil {
+		return false, err
+	}
 
-	if globalErr != nil {
-		return isLastPage, globalErr
+	for _, word := range a.page.words {
+		common.PrintInfo("Letter %s, Page %d: %s", letter, a.page.currentPage, word)
+	}
+	if err := database.InsertWords(db, a.page.words); err != nil {
+		return false, err
 	}
 
+	isLastPage := !a.page.hasNext || (a.page.totalPages > 0 && a.page.currentPage >= a.page.totalPages)
+	if isLastPage {
+		common.PrintSuccess("Finished scraping words for letter %s. Total pages: %d", letter, a.page.totalPages)
+	}
 	return isLastPage, nil
 }
 
-func SearchWord(word string, optionProxy string, providerProxy string) ([]ResponseSearch, error) {
+// SearchWord looks word up in KBBI. The result names the provider that was
+// used even when err is set.
+func SearchWord(word string, opts SearchOptions) (*SearchResult, error) {
+	result := &SearchResult{Provider: providerName(opts)}
+	var err error
+
+	if opts.OptionProxy == "datacenter" && opts.Chain != nil {
+		result.Provider, err = opts.Chain.Do(func(p proxy.Provider) error {
+			providerOpts := opts
+			providerOpts.Provider = p
+			if p == nil {
+				providerOpts.OptionProxy = ""
+			}
+
+			var err error
+			result.Entries, err = searchWordWithRetry(word, providerOpts)
+			return err
+		}, isProviderFailure)
+	} else {
+		result.Entries, err = searchWordWithRetry(word, opts)
+	}
+
+	if err != nil {
+		result.Entries = nil
+		if errors.Is(err, ErrLimitReached) {
+			common.PrintError("your search has reached the maximum limit in a day")
+			return result, err
+		}
+		return result, fmt.Errorf("\nsearch failed: %w", err)
+	}
+
+	if result.Entries == nil {
+		result.Entries = []ResponseSearch{}
+	}
+
+	return result, nil
+}
+
+func searchWordWithRetry(word string, opts SearchOptions) ([]ResponseSearch, error) {
+	var dataResponse []ResponseSearch
+
+	err := GetRetryPolicy().Do(fmt.Sprintf("search '%s' via %s", word, providerName(opts)), func(attempt int) error {
+		var err error
+		dataResponse, err = searchWordWithAccounts(word, opts)
+		return err
+	})
+
+	return dataResponse, err
+}
+
+// isProviderFailure tells the failover chain whether err is worth trying
+// the next provider for. Running out of accounts is not.
+func isProviderFailure(err error) bool {
+	return !errors.Is(err, ErrNoAccountAvailable) &&
+		!errors.Is(err, ErrSessionExpired) &&
+		!errors.Is(err, ErrDailyCapReached) &&
+		!errors.Is(err, ErrDisallowedByRobots) &&
+		!errors.Is(err, ErrResponseTooLarge) &&
+		!errors.Is(err, proxy.ErrCreditBudgetReached)
+}
+
+func recordUsage(opts SearchOptions, header http.Header, err error) {
+	if opts.Ledger == nil {
+		return
+	}
+
+	if httpcache.IsCached(header) {
+		opts.Ledger.Record("cache", 0, err == nil)
+		return
+	}
+
+	name := providerName(opts)
+	credits := 0.0
+	if opts.OptionProxy == "datacenter" && opts.Provider != nil {
+		credits = opts.Provider.Cost(header)
+		if remaining, ok := opts.Provider.Credits(header); ok {
+			opts.Ledger.SetRemaining(name, remaining)
+		}
+	}
+
+	opts.Ledger.Record(name, credits, err == nil)
+}
+
+func providerName(opts SearchOptions) string {
+	switch opts.OptionProxy {
+	case "residential":
+		return "residential"
+	case "datacenter":
+		if opts.Provider != nil {
+			return opts.Provider.Name()
+		}
+	}
+	return proxy.DIRECT
+}
+
+// searchWordWithAccounts borrows a session from the account pool, if any,
+// and moves on to the next healthy account when KBBI refuses the current one.
+func searchWordWithAccounts(word string, opts SearchOptions) ([]ResponseSearch, error) {
+	if opts.Accounts == nil {
+		return searchWordWithSession(word, opts)
+	}
+
+	for {
+		acc, err := opts.Accounts.Acquire()
+		if err != nil {
+			return nil, err
+		}
+
+		accountOpts := opts
+		accountOpts.Session = acc.Session
+		dataResponse, err := searchWordWithSession(word, accountOpts)
+		opts.Accounts.Release(acc, err)
+
+		if errors.Is(err, ErrLimitReached) || errors.Is(err, ErrAccountBanned) {
+			continue
+		}
+
+		return dataResponse, err
+	}
+}
+
+// searchWordWithSession runs one search and, when the session cookie turns
+// out to be expired, logs in again and repeats the search once.
+func searchWordWithSession(word string, opts SearchOptions) ([]ResponseSearch, error) {
+	if opts.Session == nil {
+		return searchWordOnce(word, opts, "")
+	}
+
+	if opts.OptionProxy == "residential" {
+		opts.Session.useProxies(opts.Proxies)
+	}
+
+	cookie, err := opts.Session.Cookie()
+	if err != nil {
+		return nil, err
+	}
+
+	dataResponse, err := searchWordOnce(word, opts, cookie)
+	if !errors.Is(err, ErrSessionExpired) {
+		return dataResponse, err
+	}
+
+	common.PrintWarning("Session for %s expired, logging in again", opts.Session.Email())
+	if err := opts.Session.Refresh(cookie); err != nil {
+		return nil, err
+	}
+
+	cookie, err = opts.Session.Cookie()
+	if err != nil {
+		return nil, err
+	}
+
+	return searchWordOnce(word, opts, cookie)
+}
+
+func searchWordOnce(word string, opts SearchOptions, cookie string) ([]ResponseSearch, error) {
 	var dataResponse []ResponseSearch
 	var globalErr error
-	maxRetries := 3
-	retryDelay := time.Second * 5
-
-	for retry := 0; retry < maxRetries; retry++ {
-		c := colly.NewCollector(
-			colly.Async(true),
-			colly.MaxDepth(2),
-			colly.AllowURLRevisit(),
-		)
-
-		setHeaders(c)
-		c.SetRequestTimeout(time.Second * 60)
-		c.Limit(&colly.LimitRule{
-			DomainGlob:  "*",
-			Parallelism: 10,
-			RandomDelay: 5 * time.Second,
-		})
+	// recognised is set once the page is either a not-found page or has
+	// entries, so anything else can be told apart from a real no-result.
+	var recognised bool
 
-		c.WithTransport(&http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		})
+	if opts.Ledger != nil && opts.Ledger.Exceeded() {
+		return nil, proxy.ErrCreditBudgetReached
+	}
 
-		c.OnHTML(".body-content", func(e *colly.HTMLElement) {
-			e.DOM.Find("h4:contains('Pesan')").NextAll().Remove()
-			e.DOM.Find("form#searchForm").PrevAll().Remove()
-			e.DOM.Find("h4:contains('Pesan')").Remove()
-			e.DOM.Find("form#searchForm").Remove()
+	c := colly.NewCollector(
+		colly.Async(true),
+		colly.MaxDepth(2),
+		colly.AllowURLRevisit(),
+	)
 
-			if checkBatasHarian(e.DOM) {
-				globalErr = fmt.Errorf("limit reached")
-				return
-			}
-			if checkFrasaNotFound(e.DOM) {
-				return
-			}
+	profile := common.RandomHeaderProfile()
+	if opts.Session != nil {
+		profile = opts.Session.HeaderProfile()
+	}
+	SetHeaders(c, profile)
+	SetSessionCookie(c, cookie)
+	c.Limit(&colly.LimitRule{
+		DomainGlob:  "*",
+		Parallelism: 10,
+		RandomDelay: 5 * time.Second,
+	})
 
-			e.DOM.Find("h2").Each(func(_ int, h2 *goquery.Selection) {
-				lemma := extractKataDasar(h2)
+	fromCache := false
+	c.OnResponse(func(r *colly.Response) {
+		fromCache = r.Headers != nil && httpcache.IsCached(*r.Headers)
+	})
 
-				prakategorial := parseArtiTypePrakategorial(h2)
-				if len(prakategorial) > 0 {
-					bentukTidakBaku := extractKataTidakBaku(h2)
-					responseObj := ResponseSearch{
-						Lema: lemma,
-						Arti: prakategorial,
-					}
+	c.OnHTML("body", func(e *colly.HTMLElement) {
+		if cookie != "" && !fromCache && checkLoggedOut(e.DOM) {
+			globalErr = ErrSessionExpired
+		}
+	})
 
-					common.LogInfo(fmt.Sprintf("Response Search Prakategorial '%s': \nKata tidak baku: %s\nresponse: %s", word, bentukTidakBaku, responseObj))
-					// dataResponse = append(dataResponse, responseObj)
-				}
+	c.OnHTML(".body-content", func(e *colly.HTMLElement) {
+		if errors.Is(globalErr, ErrSessionExpired) {
+			return
+		}
 
-				list := h2.NextUntil("h2").Filter("ul, ol")
-				if list.Length() > 0 {
-					responseObj := ResponseSearch{
-						Lema: lemma,
-						Arti: parseArti(list),
-					}
-					dataResponse = append(dataResponse, responseObj)
-				}
-			})
-		})
+		e.DOM.Find("h4:contains('Pesan')").NextAll().Remove()
+		e.DOM.Find("form#searchForm").PrevAll().Remove()
+		e.DOM.Find("h4:contains('Pesan')").Remove()
+		e.DOM.Find("form#searchForm").Remove()
 
-		c.OnError(func(r *colly.Response, err error) {
-			globalErr = err
-			if r.StatusCode >= 400 && r.StatusCode < 600 {
-				var errorResponse map[string]interface{}
-				jsonErr := json.Unmarshal(r.Body, &errorResponse)
-				if jsonErr == nil {
-					if detail, ok := errorResponse["detail"]; ok {
-						globalErr = fmt.Errorf("%s: %s", r.Request.URL, detail)
-						return
-					}
+		if checkBatasHarian(e.DOM) {
+			globalErr = ErrLimitReached
+			return
+		}
+		if checkFrasaNotFound(e.DOM) {
+			recognised = true
+			return
+		}
+
+		e.DOM.Find("h2").Each(func(_ int, h2 *goquery.Selection) {
+			recognised = true
+			lemma := extractKataDasar(h2)
+
+			prakategorial := parseArtiTypePrakategorial(h2)
+			if len(prakategorial) > 0 {
+				bentukTidakBaku := extractKataTidakBaku(h2)
+				responseObj := ResponseSearch{
+					Lema: lemma,
+					Arti: prakategorial,
 				}
-				globalErr = fmt.Errorf("%s: %s", r.Request.URL, r.Body)
+
+				common.LogInfo(fmt.Sprintf("Response Search Prakategorial '%s': \nKata tidak baku: %s\nresponse: %s", word, bentukTidakBaku, responseObj))
+				// dataResponse = append(dataResponse, responseObj)
 			}
-		})
 
-		c.OnResponse(func(r *colly.Response) {
-			if r.StatusCode == 200 && len(r.Body) == 0 {
-				fmt.Printf("Received %s empty body with 200 status code", word)
+			list := h2.NextUntil("h2").Filter("ul, ol")
+			if list.Length() > 0 {
+				responseObj := ResponseSearch{
+					Lema: lemma,
+					Arti: parseArti(list),
+				}
+				dataResponse = append(dataResponse, responseObj)
 			}
 		})
+	})
 
-		urlKbbi, errProxy := setProxy(c, word, optionProxy, providerProxy)
-		if errProxy != nil {
-			return nil, fmt.Errorf("\nfailed to set proxy: %w", errProxy)
+	c.OnError(func(r *colly.Response, err error) {
+		globalErr = newResponseError(r, err)
+		if opts.OptionProxy == "datacenter" && opts.Provider != nil {
+			var httpErr *HTTPError
+			if errors.As(globalErr, &httpErr) {
+				httpErr.Detail = opts.Provider.ParseError(r.StatusCode, r.Body)
+			}
 		}
+	})
 
-		err := c.Visit(urlKbbi)
-		if err != nil {
-			if isEOF(err) {
-				common.PrintError(fmt.Sprintf("EOF error occurred. Retrying in %v... (Attempt %d/%d)", retryDelay, retry+1, maxRetries))
-				time.Sleep(retryDelay)
-				continue
+	c.OnResponse(func(r *colly.Response) {
+		if opts.OptionProxy == "datacenter" && opts.Provider != nil {
+			if err := opts.Provider.Validate(*r.Headers, r.Body); err != nil {
+				globalErr = err
+				return
 			}
+		}
+		if isBannedURL(r.Request.URL) {
+			globalErr = ErrAccountBanned
+			return
+		}
+		if cookie != "" && isLoginURL(r.Request.URL) {
+			globalErr = ErrSessionExpired
+			return
+		}
+		if r.StatusCode == 200 && len(r.Body) == 0 {
+			common.PrintWarning("Received %s empty body with 200 status code", word)
+		}
+	})
 
-			return nil, fmt.Errorf("\nsearch failed: %w", err)
+	var usedProxy string
+	var responseHeader http.Header
+	c.OnResponse(func(r *colly.Response) {
+		usedProxy = r.Request.ProxyURL
+		if r.Headers != nil {
+			responseHeader = *r.Headers
 		}
+	})
+	c.OnError(func(r *colly.Response, err error) {
+		usedProxy = r.Request.ProxyURL
+		if r.Headers != nil {
+			responseHeader = *r.Headers
+		}
+	})
 
-		c.Wait()
+	urlKbbi, proxyFunc, errProxy := setProxy(c, word, opts, cookie)
+	if errProxy != nil {
+		return nil, fmt.Errorf("\nfailed to set proxy: %w", errProxy)
+	}
+	UseTransport(c, proxyFunc, providerName(opts))
 
-		if globalErr != nil {
-			if globalErr.Error() == "limit reached" {
-				common.PrintError("your search has reached the maximum limit in a day")
-				return nil, fmt.Errorf("limit reached")
-			} else if isEOF(globalErr) {
-				if retry == maxRetries-1 {
-					return nil, fmt.Errorf("\nEOF error occurred: %w", globalErr)
-				}
-				common.PrintError(fmt.Sprintf("EOF error occurred. Retrying in %v... (Attempt %d/%d)", retryDelay, retry+1, maxRetries))
-				time.Sleep(retryDelay)
-				continue
-			} else {
-				return nil, fmt.Errorf("\nsomething went wrong: %w", globalErr)
-			}
-		} else {
-			break
-		}
+	if err := c.Visit(urlKbbi); err != nil {
+		return nil, err
+	}
+
+	c.Wait()
+
+	if globalErr == nil && !recognised {
+		globalErr = fmt.Errorf("%w: %s%s", ErrParseFailed, KBBI_URL, word)
+	}
+
+	recordUsage(opts, responseHeader, globalErr)
+
+	if opts.OptionProxy == "residential" && opts.Proxies != nil && blamesProxy(globalErr, cookie) {
+		opts.Proxies.Report(usedProxy, globalErr.Error())
+	}
+	if globalErr != nil && !errors.Is(globalErr, ErrSessionExpired) && !errors.Is(globalErr, ErrAccountBanned) && !errors.Is(globalErr, ErrResponseTooLarge) {
+		stickyFor(opts).Rotate()
 	}
 
-	if len(dataResponse) == 0 {
-		return []ResponseSearch{}, nil
+	if globalErr != nil {
+		return nil, globalErr
 	}
 
 	return dataResponse, nil
 }
 
-func isEOF(err error) bool {
-	if err == nil {
-		return false
+// newResponseError turns a failed colly response into an HTTPError when the
+// server answered, so the retry policy can tell 429 and 5xx apart.
+func newResponseError(r *colly.Response, err error) error {
+	if r == nil || r.StatusCode < 400 || r.StatusCode >= 600 {
+		return err
 	}
 
-	errString := err.Error()
-	if err == io.EOF ||
-		strings.Contains(errString, "EOF") ||
-		strings.Contains(errString, "connection reset by peer") ||
-		strings.Contains(errString, "broken pipe") ||
-		strings.Contains(errString, "use of closed network connection") {
-		return true
+	httpErr := &HTTPError{
+		StatusCode: r.StatusCode,
+		URL:        r.Request.URL.String(),
+		Detail:     string(r.Body),
 	}
 
-	if netErr, ok := err.(*net.OpError); ok {
-		if netErr.Err != nil && strings.Contains(netErr.Err.Error(), "EOF") {
-			return true
+	var errorResponse map[string]interface{}
+	if jsonErr := json.Unmarshal(r.Body, &errorResponse); jsonErr == nil {
+		if detail, ok := errorResponse["detail"]; ok {
+			httpErr.Detail = fmt.Sprint(detail)
 		}
 	}
 
-	return false
-}
-
-func setHeaders(c *colly.Collector) {
-	scrapeopsAPIKey := os.Getenv("SCRAPE_OPS")
-	var headersList []map[string]string
-
-	if scrapeopsAPIKey != "" {
-		headersList = common.GetHeadersList()
+	if r.Headers != nil {
+		httpErr.RetryAfter = parseRetryAfter(r.Headers.Get("Retry-After"))
 	}
 
+	return httpErr
+}
+
+// SetHeaders sends the headers of profile with every request of c. The
+// same profile is kept for a whole session so the User-Agent and sec-ch-*
+// headers stay consistent between requests. Polite mode sends only its
+// contact User-Agent, without posing as a browser.
+func SetHeaders(c *colly.Collector, profile common.HeaderProfile) {
 	c.OnRequest(func(r *colly.Request) {
 		r.Headers.Set("Accept-Language", "en-US,en;q=0.9")
+		if politeness != nil {
+			r.Headers.Set("User-Agent", politeness.UserAgent)
+			return
+		}
+
 		r.Headers.Set("Cache-Control", "no-cache")
 		r.Headers.Set("Pragma", "no-cache")
 		r.Headers.Set("DNT", "1")
 		r.Headers.Set("Upgrade-Insecure-Requests", "1")
-		if scrapeopsAPIKey != "" {
-			randomHeader := common.RandomHeader(headersList)
-			for key, value := range randomHeader {
-				r.Headers.Set(key, value)
-			}
+		for key, value := range profile {
+			r.Headers.Set(key, value)
 		}
 	})
 }
 
-func setProxy(c *colly.Collector, word string, optionProxy string, providerProxy string) (string, error) {
+// SetSessionCookie attaches the KBBI session cookie to every request of c.
+func SetSessionCookie(c *colly.Collector, cookie string) {
+	if cookie == "" {
+		return
+	}
+
+	c.OnRequest(func(r *colly.Request) {
+		r.Headers.Set("Cookie", fmt.Sprintf("%s=%s", KBBI_COOKIE_NAME, cookie))
+	})
+}
+
+// anonymousSticky pins the exit IP of searches made without a KBBI session.
+var anonymousSticky = &proxy.StickySession{}
+
+// stickyFor returns the session ID source of the session opts searches
+// with. Each login session keeps its own exit IP.
+func stickyFor(opts SearchOptions) *proxy.StickySession {
+	if opts.Session != nil {
+		return opts.Session.Sticky()
+	}
+	return anonymousSticky
+}
+
+// setProxy returns the URL to visit for word and, in residential mode, the
+// proxy function for the transport.
+func setProxy(c *colly.Collector, word string, opts SearchOptions, cookie string) (string, colly.ProxyFunc, error) {
 	urlKbbi := fmt.Sprintf("%s%s", KBBI_URL, word)
-	if optionProxy != "" {
-		if optionProxy == "residential" {
-			proxyResidential := common.GetProxyResidential()
+	provider := opts.Provider
+	var proxyFunc colly.ProxyFunc
+	if opts.OptionProxy != "" {
+		if opts.OptionProxy == "residential" {
+			if opts.Proxies == nil {
+				return "", nil, fmt.Errorf("\nno residential proxies configured")
+			}
 
-			rp, err := proxy.RoundRobinProxySwitcher(proxyResidential...)
-			if err != nil {
-				return "", fmt.Errorf("\nfailed to create proxy switcher: %w", err)
+			proxyFunc = opts.Proxies.ProxyFunc(opts.Proxies.SessionID(stickyFor(opts)))
+		} else if opts.OptionProxy == "datacenter" {
+			if provider == nil {
+				return "", nil, fmt.Errorf("\nno datacenter provider selected")
 			}
 
-			c.SetProxyFunc(rp)
-		} else if optionProxy == "datacenter" {
-			pu, err := common.GetProxyDataCenter(urlKbbi, providerProxy)
+			pu, err := provider.BuildURL(urlKbbi, cookie, proxy.SessionID(provider, stickyFor(opts)))
 			if err != nil {
-				return "", fmt.Errorf("\nfailed to get proxy endpoint: %w", err)
+				return "", nil, fmt.Errorf("\nfailed to get proxy endpoint: %w", err)
+			}
+
+			if hp, ok := provider.(proxy.HeaderProvider); ok {
+				c.OnRequest(func(r *colly.Request) {
+					for key, values := range hp.Header() {
+						for _, value := range values {
+							r.Headers.Set(key, value)
+						}
+					}
+				})
 			}
 
 			urlKbbi = pu
 		}
 	}
 
-	return urlKbbi, nil
+	return urlKbbi, proxyFunc, nil
 }
@@ -18,12 +18,9 @@
 package lema
 
 import (
-	"bufio"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
-	"sync"
+	"time"
 
 	"kbbi-scraper/internal/common"
 	"kbbi-scraper/internal/database"
@@ -33,33 +30,6 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
-const NORESULT_FILE = "no_result_word.json"
-
-type NoResult struct {
-	Word string `json:"word"`
-	Url  string `json:"url"`
-}
-
-func ReadWordsFromFile(filename string) ([]string, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("error opening file: %w", err)
-	}
-	defer file.Close()
-
-	var words []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		words = append(words, scanner.Text())
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading file: %w", err)
-	}
-
-	return words, nil
-}
-
 func saveToDatabase(db *sqlx.DB, results []kbbi.ResponseSearch, searchedWord string) error {
 	var lemas []database.Lema
 	for _, result := range results {
@@ -75,92 +45,100 @@ func saveToDatabase(db *sqlx.DB, results []kbbi.ResponseSearch, searchedWord str
 	return database.InsertLemas(db, lemas)
 }
 
-func ProcessBatch(words []string, batchSize int, concurrency int, db *sqlx.DB, optionProxy string, providerProxy string) {
-	total := len(words)
-	processed := 0
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, concurrency)
-
-	for i := 0; i < total; i += batchSize {
-		end := i + batchSize
-		if end > total {
-			end = total
-		}
-
-		batch := words[i:end]
-		wg.Add(1)
-		go func(batch []string) {
-			defer wg.Done()
-			for _, word := range batch {
-				semaphore <- struct{}{}
-				go func(word string) {
-					defer func() { <-semaphore }()
-
-					err := processWord(word, db, optionProxy, providerProxy)
-					if err != nil {
-						common.PrintError("Error processing word '%s': %v", word, err)
-					}
-				}(word)
+func processWord(word string, db *sqlx.DB, opts kbbi.SearchOptions, settings jobSettings, completed *Completed) WordResult {
+	start := time.Now()
+
+	var result WordResult
+	claimed := settings.leased
+	var err error
+	if !claimed {
+		claimed, err = database.ClaimJob(db, word, settings.owner, settings.lease)
+	}
+
+	switch {
+	case err != nil:
+		result = WordResult{Outcome: OutcomeFailed, Err: err}
+	case !claimed:
+		common.PrintInfo("word '%s' job is finished or taken by another worker", word)
+		result = WordResult{Outcome: OutcomeSkipped}
+	default:
+		result = searchAndSave(word, db, opts, completed)
+		if err := recordJob(db, word, result, opts, settings); err != nil {
+			if errors.Is(err, database.ErrLeaseLost) {
+				common.PrintWarning("Lost the lease on '%s' to another worker", word)
 			}
-		}(batch)
+			common.LogError(fmt.Sprintf("Error recording job '%s'", word), err)
+		}
+	}
 
-		processed += len(batch)
+	result.Word = word
+	result.Duration = time.Since(start)
 
-		common.PrintCustom("[PROGRESS] %d/%d words processed", color.FgCyan, true, processed, total)
+	if result.Err != nil {
+		common.PrintError("Error processing word '%s': %v", word, result.Err)
 	}
-
-	wg.Wait()
+	return result
 }
 
-func processWord(word string, db *sqlx.DB, optionProxy string, providerProxy string) error {
-	checkExist, errCheck := database.ExistsLemaByKata(db, word)
-	if errCheck != nil {
-		return fmt.Errorf("error checking in the database: %w", errCheck)
+// recordJob stores the outcome of a claimed job. Errors that stop the whole
+// run are not the word's fault, so its attempt is given back.
+func recordJob(db *sqlx.DB, word string, result WordResult, opts kbbi.SearchOptions, settings jobSettings) error {
+	switch {
+	case result.Outcome == OutcomeFailed && isFatal(result.Err, opts):
+		return database.ReleaseJob(db, word, settings.owner)
+	case result.Outcome == OutcomeFailed && errors.Is(result.Err, kbbi.ErrParseFailed):
+		return database.FinishJob(db, word, settings.owner, database.JobParseError, result.Provider, result.Err)
+	case result.Outcome == OutcomeFailed:
+		return database.FailJob(db, word, settings.owner, result.Provider, result.Err, settings.maxAttempts)
+	default:
+		return database.FinishJob(db, word, settings.owner, result.jobStatus, result.Provider, nil)
 	}
+}
 
-	if checkExist {
+func searchAndSave(word string, db *sqlx.DB, opts kbbi.SearchOptions, completed *Completed) WordResult {
+	switch completed.Status(word) {
+	case database.JobDone:
 		common.PrintInfo("word '%s' data in the database already exists", word)
-		return nil
-	}
-
-	if checkWordOnNoResults(word) {
-		common.PrintWarning("The word '%s' is in the list of files with no results", word)
-		return nil
+		return WordResult{Outcome: OutcomeSkipped, jobStatus: database.JobDone}
+	case database.JobNoResult:
+		common.PrintWarning("The word '%s' is in the list of words with no results", word)
+		return WordResult{Outcome: OutcomeSkipped, jobStatus: database.JobNoResult}
 	}
 
 	common.PrintInfo("Processing '%s'", word)
-	results, err := kbbi.SearchWord(word, optionProxy, providerProxy)
+	searchResult, err := kbbi.SearchWord(word, opts)
 	if err != nil {
 		message := fmt.Sprintf("Error searching for '%s'\n", word)
 		common.LogError(message, err)
-		return fmt.Errorf("searching for '%s': %w", word, err)
+		return WordResult{Outcome: OutcomeFailed, Provider: searchResult.Provider, Err: fmt.Errorf("searching for '%s': %w", word, err)}
 	}
 
+	results := searchResult.Entries
 	if len(results) == 0 {
 		url := fmt.Append([]byte(kbbi.KBBI_URL), word)
 		message := fmt.Sprintf("[NO RESULT] No results found for '%s': %s\n", word, url)
 		common.PrintError(message)
 		common.LogInfo(message)
-		addNoResult(NoResult{
-			Word: word,
-			Url:  string(url),
-		})
-		return nil
+		if err := completed.noResults.Add(NoResult{Word: word, Url: string(url)}); err != nil {
+			return WordResult{Outcome: OutcomeFailed, Provider: searchResult.Provider, Err: fmt.Errorf("error saving no-result word '%s': %w", word, err)}
+		}
+		return WordResult{Outcome: OutcomeNoResult, Provider: searchResult.Provider, jobStatus: database.JobNoResult}
 	}
 
 	errInsert := saveToDatabase(db, results, word)
 	if errInsert != nil {
 		message := fmt.Sprintf("error inserting '%s'\n", word)
 		common.LogError(message, errInsert)
-		return fmt.Errorf("error inserting '%s': %w", word, errInsert)
+		return WordResult{Outcome: OutcomeFailed, Provider: searchResult.Provider, Err: fmt.Errorf("error inserting '%s': %w", word, errInsert)}
 	}
+	completed.addScraped(word)
 
 	common.PrintCustom("========================================", color.FgGreen, true)
-	common.PrintSuccess("Successfully processed word '%s'", word)
+	common.PrintSuccess("Successfully processed word '%s' via %s", word, searchResult.Provider)
 	for iLema, result := range results {
 		common.PrintCustom("Lema: %s", color.FgMagenta, true, result.Lema)
 		for iArti, arti := range result.Arti {
-			fmt.Printf("  Arti %d\n", iArti+1)
+			common.PrintCustom("  Arti %d", color.FgWhite, false, iArti+1)
 			common.PrintCustom("  Kelas Kata: %s", color.FgMagenta, true, arti.KelasKata)
 			common.PrintCustom("  Keterangan: %s", color.FgMagenta, true, arti.Keterangan)
 			if iArti < len(result.Arti)-1 {
@@ -174,54 +152,5 @@ func processWord(word string, db *sqlx.DB, optionProxy string, providerProxy str
 	}
 	common.PrintCustom("========================================", color.FgGreen, true)
 
-	return nil
-}
-
-func saveNoResults(results []NoResult) {
-	data, err := json.Marshal(results)
-	if err != nil {
-		log.Printf("Error marshaling noresults: %v", err)
-		return
-	}
-
-	err = os.WriteFile(NORESULT_FILE, data, 0644)
-	if err != nil {
-		log.Printf("Error saving noresults: %v", err)
-	}
-}
-
-func loadNoResults() []NoResult {
-	data, err := os.ReadFile(NORESULT_FILE)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []NoResult{}
-		}
-		log.Printf("Error reading noresults file: %v", err)
-		return []NoResult{}
-	}
-
-	var results []NoResult
-	err = json.Unmarshal(data, &results)
-	if err != nil {
-		log.Printf("Error unmarshaling noresults: %v", err)
-		return []NoResult{}
-	}
-
-	return results
-}
-
-func checkWordOnNoResults(word string) bool {
-	results := loadNoResults()
-	for _, result := range results {
-		if result.Word == word {
-			return true
-		}
-	}
-	return false
-}
-
-func addNoResult(newResult NoResult) {
-	results := loadNoResults()
-	results = append(results, newResult)
-	saveNoResults(results)
+	return WordResult{Outcome: OutcomeDone, Provider: searchResult.Provider, jobStatus: database.JobDone}
 }
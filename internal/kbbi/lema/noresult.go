@@ -0,0 +1,161 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package lema
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/database"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// NORESULT_FILE is the JSON list older versions kept no-result words in.
+// It is imported into the no_results table the first time it is seen and
+// then renamed to NORESULT_FILE + ".imported".
+const NORESULT_FILE = "no_result_word.json"
+
+type NoResult struct {
+	Word string `json:"word"`
+	Url  string `json:"url"`
+}
+
+// NoResultStore is the set of words KBBI has no entry for. Lookups are
+// answered from memory and additions are written through to the
+// no_results table, so concurrent workers can share one store.
+type NoResultStore struct {
+	mu    sync.RWMutex
+	db    *sqlx.DB
+	words map[string]struct{}
+}
+
+// LoadNoResultStore reads the no_results table into memory, importing
+// NORESULT_FILE first when it exists and was not imported yet.
+func LoadNoResultStore(db *sqlx.DB) (*NoResultStore, error) {
+	s := &NoResultStore{db: db, words: map[string]struct{}{}}
+
+	err := database.EachNoResult(db, func(result database.NoResult) error {
+		s.words[result.Kata] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading no-result words: %w", err)
+	}
+
+	if _, err := os.Stat(NORESULT_FILE); err == nil {
+		n, err := s.Import(NORESULT_FILE)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			common.PrintInfo("Imported %d no-result words from %s", n, NORESULT_FILE)
+		}
+		if err := os.Rename(NORESULT_FILE, NORESULT_FILE+".imported"); err != nil {
+			return nil, fmt.Errorf("error marking %s as imported: %w", NORESULT_FILE, err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *NoResultStore) Contains(word string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.words[word]
+	return ok
+}
+
+func (s *NoResultStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.words)
+}
+
+func (s *NoResultStore) Add(result NoResult) error {
+	_, err := s.AddAll([]NoResult{result})
+	return err
+}
+
+// AddAll records the results not in the store yet and returns how many
+// were new. The insert runs without the lock, so lookups by other workers
+// do not wait on the database.
+func (s *NoResultStore) AddAll(results []NoResult) (int, error) {
+	var rows []database.NoResult
+	seen := map[string]bool{}
+
+	s.mu.RLock()
+	for _, result := range results {
+		if _, ok := s.words[result.Word]; ok || seen[result.Word] || result.Word == "" {
+			continue
+		}
+		seen[result.Word] = true
+		rows = append(rows, database.NoResult{Kata: result.Word, Url: result.Url})
+	}
+	s.mu.RUnlock()
+
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	if err := database.InsertNoResults(s.db, rows); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added := 0
+	for _, row := range rows {
+		if _, ok := s.words[row.Kata]; !ok {
+			s.words[row.Kata] = struct{}{}
+			added++
+		}
+	}
+	return added, nil
+}
+
+// Import adds the words of a JSON list in the old no_result_word.json
+// format.
+func (s *NoResultStore) Import(file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %w", file, err)
+	}
+
+	var results []NoResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return 0, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+
+	return s.AddAll(results)
+}
+
+// Words returns the stored words in no particular order.
+func (s *NoResultStore) Words() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	words := make([]string, 0, len(s.words))
+	for word := range s.words {
+		words = append(words, word)
+	}
+	return words
+}
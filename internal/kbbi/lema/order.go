@@ -0,0 +1,227 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package lema
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"kbbi-scraper/internal/common"
+)
+
+// Scheduling orders. OrderFile keeps the wordlist as it is.
+const (
+	OrderFile      = "file"
+	OrderReverse   = "reverse"
+	OrderRandom    = "random"
+	OrderShortest  = "shortest"
+	OrderPrefix    = "prefix"
+	OrderFrequency = "frequency"
+)
+
+var Orders = []string{OrderFile, OrderReverse, OrderRandom, OrderShortest, OrderPrefix, OrderFrequency}
+
+const DEFAULT_PREFIX_LENGTH = 2
+
+// Order decides which words are scraped first, which matters when the
+// quota runs out before the list does.
+type Order struct {
+	Strategy string
+	// Seed makes OrderRandom repeatable.
+	Seed int64
+	// PrefixLength is how many letters OrderPrefix groups by.
+	PrefixLength int
+	// FrequencyFile lists words most useful first, optionally followed by
+	// a count, for OrderFrequency.
+	FrequencyFile string
+}
+
+// LoadOrder reads WORDLIST_ORDER, WORDLIST_SEED, WORDLIST_PREFIX_LENGTH and
+// WORDLIST_FREQUENCY_FILE. Without a seed a random one is picked and
+// printed so the run can be repeated.
+func LoadOrder() (Order, error) {
+	o := Order{
+		Strategy:      strings.ToLower(os.Getenv("WORDLIST_ORDER")),
+		PrefixLength:  common.GetEnvInt("WORDLIST_PREFIX_LENGTH", DEFAULT_PREFIX_LENGTH),
+		FrequencyFile: os.Getenv("WORDLIST_FREQUENCY_FILE"),
+	}
+	if o.Strategy == "" {
+		o.Strategy = OrderFile
+	}
+	if !slices.Contains(Orders, o.Strategy) {
+		return o, fmt.Errorf("invalid WORDLIST_ORDER %q, expected one of %s", o.Strategy, strings.Join(Orders, "/"))
+	}
+	if o.Strategy == OrderFrequency && o.FrequencyFile == "" {
+		return o, fmt.Errorf("WORDLIST_ORDER=frequency needs WORDLIST_FREQUENCY_FILE")
+	}
+
+	if seed := os.Getenv("WORDLIST_SEED"); seed != "" {
+		n, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			return o, fmt.Errorf("invalid WORDLIST_SEED %q", seed)
+		}
+		o.Seed = n
+	} else {
+		o.Seed = time.Now().UnixNano()
+	}
+
+	return o, nil
+}
+
+func (o Order) String() string {
+	switch o.Strategy {
+	case OrderRandom:
+		return fmt.Sprintf("%s (seed %d)", o.Strategy, o.Seed)
+	case OrderPrefix:
+		return fmt.Sprintf("%s (%d letters)", o.Strategy, o.PrefixLength)
+	case OrderFrequency:
+		return fmt.Sprintf("%s (%s)", o.Strategy, o.FrequencyFile)
+	default:
+		return o.Strategy
+	}
+}
+
+// Apply sorts words in place and returns them.
+func (o Order) Apply(words []string) ([]string, error) {
+	switch o.Strategy {
+	case OrderReverse:
+		slices.Reverse(words)
+	case OrderRandom:
+		r := rand.New(rand.NewSource(o.Seed))
+		r.Shuffle(len(words), func(i, j int) {
+			words[i], words[j] = words[j], words[i]
+		})
+	case OrderShortest:
+		slices.SortStableFunc(words, func(a, b string) int {
+			return utf8.RuneCountInString(a) - utf8.RuneCountInString(b)
+		})
+	case OrderPrefix:
+		// Groups appear in the order their first word does, and words
+		// keep their file order inside a group.
+		first := map[string]int{}
+		for i, word := range words {
+			if _, ok := first[o.prefix(word)]; !ok {
+				first[o.prefix(word)] = i
+			}
+		}
+		slices.SortStableFunc(words, func(a, b string) int {
+			return first[o.prefix(a)] - first[o.prefix(b)]
+		})
+	case OrderFrequency:
+		rank, err := loadFrequencyRank(o.FrequencyFile)
+		if err != nil {
+			return nil, err
+		}
+		// Words missing from the list go last, in file order.
+		position := func(word string) int {
+			if r, ok := rank[CanonicalKey(word)]; ok {
+				return r
+			}
+			return len(rank)
+		}
+		slices.SortStableFunc(words, func(a, b string) int {
+			return position(a) - position(b)
+		})
+	}
+	return words, nil
+}
+
+func (o Order) prefix(word string) string {
+	key := CanonicalKey(word)
+	n := 0
+	for i := range key {
+		if n == o.PrefixLength {
+			return key[:i]
+		}
+		n++
+	}
+	return key
+}
+
+// loadFrequencyRank reads a frequency list with one word per line,
+// optionally followed by whitespace and a count. Lines with a count are
+// ranked by it, highest first; otherwise the line order is the rank.
+func loadFrequencyRank(file string) (map[string]int, error) {
+	source, err := OpenSource(file, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening frequency list: %w", err)
+	}
+	defer source.Close()
+
+	type entry struct {
+		key   string
+		count float64
+		line  int
+	}
+	var entries []entry
+	seen := map[string]bool{}
+
+	for line := 0; ; line++ {
+		text, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading frequency list: %w", err)
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		e := entry{line: line}
+		word := fields
+		if len(fields) > 1 {
+			if count, err := strconv.ParseFloat(fields[len(fields)-1], 64); err == nil {
+				e.count = count
+				word = fields[:len(fields)-1]
+			}
+		}
+		e.key = CanonicalKey(strings.Join(word, " "))
+		if seen[e.key] {
+			continue
+		}
+		seen[e.key] = true
+		entries = append(entries, e)
+	}
+
+	slices.SortStableFunc(entries, func(a, b entry) int {
+		switch {
+		case a.count > b.count:
+			return -1
+		case a.count < b.count:
+			return 1
+		default:
+			return a.line - b.line
+		}
+	})
+
+	rank := make(map[string]int, len(entries))
+	for i, e := range entries {
+		rank[e.key] = i
+	}
+	return rank, nil
+}
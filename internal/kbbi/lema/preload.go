@@ -0,0 +1,95 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package lema
+
+import (
+	"fmt"
+	"sync"
+
+	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/database"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Completed knows which words need no request: those with lema rows and
+// those KBBI has no entry for. It is loaded with one streaming query per
+// table at the start of a run, so workers never ask the database.
+type Completed struct {
+	mu        sync.RWMutex
+	scraped   map[string]struct{}
+	noResults *NoResultStore
+}
+
+func LoadCompleted(db *sqlx.DB) (*Completed, error) {
+	noResults, err := LoadNoResultStore(db)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Completed{scraped: map[string]struct{}{}, noResults: noResults}
+	err = database.EachLemaKata(db, func(kata string) error {
+		c.scraped[kata] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading scraped words: %w", err)
+	}
+
+	common.PrintInfo("Loaded %d scraped and %d no-result words", len(c.scraped), noResults.Len())
+	return c, nil
+}
+
+// Status returns the job status word already has, or "" when it still
+// has to be scraped.
+func (c *Completed) Status(word string) string {
+	c.mu.RLock()
+	_, ok := c.scraped[word]
+	c.mu.RUnlock()
+
+	switch {
+	case ok:
+		return database.JobDone
+	case c.noResults.Contains(word):
+		return database.JobNoResult
+	default:
+		return ""
+	}
+}
+
+func (c *Completed) addScraped(word string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scraped[word] = struct{}{}
+}
+
+// Filter splits words into those still to do and those already done or
+// without result.
+func (c *Completed) Filter(words []string) (todo, done, noResult []string) {
+	for _, word := range words {
+		switch c.Status(word) {
+		case database.JobDone:
+			done = append(done, word)
+		case database.JobNoResult:
+			noResult = append(noResult, word)
+		default:
+			todo = append(todo, word)
+		}
+	}
+	return todo, done, noResult
+}
@@ -0,0 +1,258 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package lema
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/database"
+	"kbbi-scraper/internal/kbbi"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Shard selects a stable subset of a wordlist: word w belongs to shard i
+// of n when fnv32a(w) % n == i-1. The zero Shard selects every word.
+type Shard struct {
+	Index int
+	Count int
+}
+
+// ParseShard reads "i/n" with 1 <= i <= n. An empty string is the zero
+// Shard.
+func ParseShard(s string) (Shard, error) {
+	if s == "" {
+		return Shard{}, nil
+	}
+
+	index, count, ok := strings.Cut(s, "/")
+	if !ok {
+		return Shard{}, fmt.Errorf("invalid shard %q, expected i/n", s)
+	}
+
+	i, errIndex := strconv.Atoi(strings.TrimSpace(index))
+	n, errCount := strconv.Atoi(strings.TrimSpace(count))
+	if errIndex != nil || errCount != nil || n < 1 || i < 1 || i > n {
+		return Shard{}, fmt.Errorf("invalid shard %q, expected i/n with 1 <= i <= n", s)
+	}
+
+	return Shard{Index: i, Count: n}, nil
+}
+
+func (s Shard) String() string {
+	if s.Count == 0 {
+		return "all"
+	}
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
+
+func (s Shard) Contains(word string) bool {
+	if s.Count <= 1 {
+		return true
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(word))
+	return int(h.Sum32()%uint32(s.Count)) == s.Index-1
+}
+
+func (s Shard) Filter(words []string) []string {
+	if s.Count <= 1 {
+		return words
+	}
+
+	var selected []string
+	for _, word := range words {
+		if s.Contains(word) {
+			selected = append(selected, word)
+		}
+	}
+	return selected
+}
+
+// ExportRecord is one line of a shard export: a lema row, or a word KBBI
+// has no entry for.
+type ExportRecord struct {
+	Kata       string `json:"kata"`
+	Lema       string `json:"lema,omitempty"`
+	KelasKata  string `json:"kelas_kata,omitempty"`
+	Keterangan string `json:"keterangan,omitempty"`
+	NoResult   bool   `json:"no_result,omitempty"`
+}
+
+type ExportStats struct {
+	Lemas    int
+	NoResult int
+}
+
+// Export writes the lema rows and no-result words of shard as JSON lines.
+func Export(db *sqlx.DB, w io.Writer, shard Shard) (ExportStats, error) {
+	var stats ExportStats
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	err := database.EachLema(db, func(l database.Lema) error {
+		if !shard.Contains(l.Kata) {
+			return nil
+		}
+		stats.Lemas++
+		return enc.Encode(ExportRecord{
+			Kata:       l.Kata,
+			Lema:       l.Lema,
+			KelasKata:  l.KelasKata,
+			Keterangan: l.Keterangan,
+		})
+	})
+	if err != nil {
+		return stats, fmt.Errorf("error exporting lemas: %w", err)
+	}
+
+	err = database.EachNoResult(db, func(result database.NoResult) error {
+		if !shard.Contains(result.Kata) {
+			return nil
+		}
+		stats.NoResult++
+		return enc.Encode(ExportRecord{Kata: result.Kata, NoResult: true})
+	})
+	if err != nil {
+		return stats, fmt.Errorf("error exporting no-result words: %w", err)
+	}
+
+	return stats, bw.Flush()
+}
+
+type MergeStats struct {
+	Lemas      int
+	NoResult   int
+	Duplicates int
+}
+
+// Merge imports shard exports into db. A word is taken from the first file
+// that has it and skipped if db already had lemas for it, so overlapping
+// shards or a re-run merge do not duplicate rows.
+func Merge(db *sqlx.DB, files []string) (MergeStats, error) {
+	var stats MergeStats
+	source := map[string]string{}
+	completed, err := LoadCompleted(db)
+	if err != nil {
+		return stats, err
+	}
+	noResults := completed.noResults
+
+	for _, file := range files {
+		var pending []database.Lema
+		var pendingNoResults []NoResult
+		flush := func() error {
+			n, err := noResults.AddAll(pendingNoResults)
+			if err != nil {
+				return err
+			}
+			stats.NoResult += n
+			pendingNoResults = pendingNoResults[:0]
+
+			if len(pending) == 0 {
+				return nil
+			}
+			if err := database.InsertLemas(db, pending); err != nil {
+				return err
+			}
+			stats.Lemas += len(pending)
+			pending = pending[:0]
+			return nil
+		}
+
+		err := readExport(file, func(record ExportRecord) error {
+			if record.NoResult {
+				pendingNoResults = append(pendingNoResults, NoResult{Word: record.Kata, Url: kbbi.KBBI_URL + record.Kata})
+				if len(pendingNoResults) >= mergeBatchSize {
+					return flush()
+				}
+				return nil
+			}
+
+			from, seen := source[record.Kata]
+			if !seen {
+				from = file
+				if completed.Status(record.Kata) == database.JobDone {
+					from = ""
+				}
+				source[record.Kata] = from
+			}
+			if from != file {
+				stats.Duplicates++
+				return nil
+			}
+
+			pending = append(pending, database.Lema{
+				Kata:       record.Kata,
+				Lema:       record.Lema,
+				KelasKata:  record.KelasKata,
+				Keterangan: record.Keterangan,
+			})
+			if len(pending) >= mergeBatchSize {
+				return flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", file, err)
+		}
+		common.PrintInfo("Merged %s", file)
+	}
+
+	return stats, nil
+}
+
+const mergeBatchSize = 500
+
+func readExport(file string, fn func(ExportRecord) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("error opening export: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var record ExportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
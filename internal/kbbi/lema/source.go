@@ -0,0 +1,277 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package lema
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// WordSource hands out the lines of a wordlist one at a time. Next returns
+// io.EOF once the source is exhausted.
+type WordSource interface {
+	Next() (string, error)
+	Close() error
+}
+
+// OpenSource opens the wordlist named by spec. It is "-" for stdin, a text
+// file with one word per line (gzip allowed), a .csv file for its first
+// column, "csv:path#column" for a CSV column by header name or 1-based
+// number, or "sql:query" for the first column of a query on db.
+//
+// Sources are read lazily, so long lists are never held in memory.
+func OpenSource(spec string, db *sqlx.DB) (WordSource, error) {
+	switch {
+	case spec == "-":
+		return newLineSource(io.NopCloser(os.Stdin))
+	case strings.HasPrefix(spec, "sql:"):
+		return newSQLSource(db, strings.TrimPrefix(spec, "sql:"))
+	case strings.HasPrefix(spec, "csv:"):
+		path, column, _ := strings.Cut(strings.TrimPrefix(spec, "csv:"), "#")
+		return openCSVSource(path, column)
+	case strings.HasSuffix(spec, ".csv") || strings.HasSuffix(spec, ".csv.gz"):
+		return openCSVSource(spec, "")
+	default:
+		file, err := os.Open(spec)
+		if err != nil {
+			return nil, fmt.Errorf("error opening file: %w", err)
+		}
+		return newLineSource(file)
+	}
+}
+
+// OpenSources reads specs one after another as a single source. Each is
+// opened only once the one before it is exhausted.
+func OpenSources(specs []string, db *sqlx.DB) WordSource {
+	return &multiSource{specs: specs, db: db}
+}
+
+// decompress transparently unpacks gzip input, recognised by its magic
+// bytes rather than the file name.
+func decompress(rc io.ReadCloser) (io.Reader, io.Closer, error) {
+	br := bufio.NewReader(rc)
+	magic, err := br.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return br, rc, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		rc.Close()
+		return nil, nil, fmt.Errorf("error reading gzip: %w", err)
+	}
+	return gz, closers{gz, rc}, nil
+}
+
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var errs []error
+	for _, closer := range c {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+type lineSource struct {
+	scanner *bufio.Scanner
+	closer  io.Closer
+}
+
+func newLineSource(rc io.ReadCloser) (WordSource, error) {
+	r, closer, err := decompress(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	return &lineSource{scanner: scanner, closer: closer}, nil
+}
+
+func (s *lineSource) Next() (string, error) {
+	if s.scanner.Scan() {
+		return s.scanner.Text(), nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return "", fmt.Errorf("error reading file: %w", err)
+	}
+	return "", io.EOF
+}
+
+func (s *lineSource) Close() error {
+	return s.closer.Close()
+}
+
+type csvSource struct {
+	reader *csv.Reader
+	closer io.Closer
+	column int
+}
+
+// openCSVSource reads column of path. A column name is looked up in the
+// header row; a number or no column means the file has no header.
+func openCSVSource(path, column string) (WordSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+
+	r, closer, err := decompress(file)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	s := &csvSource{reader: reader, closer: closer}
+
+	if column == "" {
+		return s, nil
+	}
+	if n, err := strconv.Atoi(column); err == nil {
+		if n < 1 {
+			closer.Close()
+			return nil, fmt.Errorf("invalid CSV column %d, columns start at 1", n)
+		}
+		s.column = n - 1
+		return s, nil
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		closer.Close()
+		return nil, fmt.Errorf("error reading CSV header of %s: %w", path, err)
+	}
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), column) {
+			s.column = i
+			return s, nil
+		}
+	}
+	closer.Close()
+	return nil, fmt.Errorf("%s has no column %q", path, column)
+}
+
+func (s *csvSource) Next() (string, error) {
+	for {
+		record, err := s.reader.Read()
+		if err == io.EOF {
+			return "", io.EOF
+		}
+		if err != nil {
+			return "", fmt.Errorf("error reading CSV: %w", err)
+		}
+		if s.column < len(record) {
+			return record[s.column], nil
+		}
+	}
+}
+
+func (s *csvSource) Close() error {
+	return s.closer.Close()
+}
+
+type sqlSource struct {
+	rows *sqlx.Rows
+}
+
+func newSQLSource(db *sqlx.DB, query string) (WordSource, error) {
+	if db == nil {
+		return nil, fmt.Errorf("sql source needs a database connection")
+	}
+
+	rows, err := db.Queryx(query)
+	if err != nil {
+		return nil, fmt.Errorf("error running wordlist query: %w", err)
+	}
+	return &sqlSource{rows: rows}, nil
+}
+
+func (s *sqlSource) Next() (string, error) {
+	if !s.rows.Next() {
+		if err := s.rows.Err(); err != nil {
+			return "", fmt.Errorf("error reading wordlist query: %w", err)
+		}
+		return "", io.EOF
+	}
+
+	columns, err := s.rows.SliceScan()
+	if err != nil {
+		return "", fmt.Errorf("error reading wordlist query: %w", err)
+	}
+	switch value := columns[0].(type) {
+	case []byte:
+		return string(value), nil
+	case nil:
+		return "", nil
+	default:
+		return fmt.Sprint(value), nil
+	}
+}
+
+func (s *sqlSource) Close() error {
+	return s.rows.Close()
+}
+
+type multiSource struct {
+	specs   []string
+	db      *sqlx.DB
+	current WordSource
+}
+
+func (s *multiSource) Next() (string, error) {
+	for {
+		if s.current == nil {
+			if len(s.specs) == 0 {
+				return "", io.EOF
+			}
+			source, err := OpenSource(s.specs[0], s.db)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", s.specs[0], err)
+			}
+			s.current, s.specs = source, s.specs[1:]
+		}
+
+		line, err := s.current.Next()
+		if err != io.EOF {
+			return line, err
+		}
+		if err := s.current.Close(); err != nil {
+			return "", err
+		}
+		s.current = nil
+	}
+}
+
+func (s *multiSource) Close() error {
+	if s.current == nil {
+		return nil
+	}
+	return s.current.Close()
+}
@@ -0,0 +1,169 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package lema
+
+import (
+	"io"
+	"strings"
+
+	"kbbi-scraper/internal/common"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/text/unicode/norm"
+)
+
+// DEFAULT_WORDLIST is read when WORDLIST_FILES is not set.
+const DEFAULT_WORDLIST = "word.txt"
+
+// WordlistReport counts what the input pipeline removed or changed. Files
+// is the number of sources read.
+type WordlistReport struct {
+	Files        int
+	Read         int
+	Blank        int
+	Comments     int
+	Normalized   int
+	Duplicates   int
+	CaseVariants int
+	Kept         int
+}
+
+func (r WordlistReport) Print() {
+	common.PrintInfo("Read %d lines from %d source(s), kept %d words", r.Read, r.Files, r.Kept)
+	if removed := r.Blank + r.Comments + r.Duplicates + r.CaseVariants; removed > 0 {
+		common.PrintInfo("  removed %d: blank=%d comments=%d duplicates=%d case_variants=%d",
+			removed, r.Blank, r.Comments, r.Duplicates, r.CaseVariants)
+	}
+	if r.Normalized > 0 {
+		common.PrintInfo("  normalized whitespace or unicode form of %d words", r.Normalized)
+	}
+}
+
+// NormalizeWord trims word, collapses inner whitespace to single spaces
+// and brings it into Unicode NFC, so composed and decomposed accents
+// compare equal.
+func NormalizeWord(word string) string {
+	return strings.Join(strings.Fields(norm.NFC.String(word)), " ")
+}
+
+// CanonicalKey is what two spellings of the same word have in common.
+func CanonicalKey(word string) string {
+	return strings.ToLower(NormalizeWord(word))
+}
+
+// LoadWordlist reads and cleans the sources in order, so a word keeps the
+// spelling and position of its first occurrence across all of them.
+// Sources are specs as understood by OpenSource.
+func LoadWordlist(specs []string, db *sqlx.DB) ([]string, WordlistReport, error) {
+	source := OpenSources(specs, db)
+	defer source.Close()
+
+	c := newCleaner()
+	var words []string
+	for {
+		line, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, WordlistReport{}, err
+		}
+		if word, ok := c.add(line); ok {
+			words = append(words, word)
+		}
+	}
+
+	c.report.Files = len(specs)
+	return words, c.report, nil
+}
+
+// CleanWordlist normalizes lines, drops blanks and comments and removes
+// every word whose canonical key was seen before.
+func CleanWordlist(lines []string) ([]string, WordlistReport) {
+	c := newCleaner()
+	var words []string
+	for _, line := range lines {
+		if word, ok := c.add(line); ok {
+			words = append(words, word)
+		}
+	}
+	return words, c.report
+}
+
+// cleaner is the pipeline behind CleanWordlist, one line at a time. It
+// keeps the canonical key of every distinct word, so its memory grows with
+// the number of distinct words, though not with the length of the list.
+// The first spelling is only stored when it differs from the key, which it
+// needs to tell duplicates from case variants.
+type cleaner struct {
+	report WordlistReport
+	first  map[string]string
+}
+
+func newCleaner() *cleaner {
+	return &cleaner{first: map[string]string{}}
+}
+
+// add returns the normalized word of line, or false when line is dropped.
+func (c *cleaner) add(line string) (string, bool) {
+	c.report.Read++
+
+	word := NormalizeWord(line)
+	switch {
+	case word == "":
+		c.report.Blank++
+		return "", false
+	case strings.HasPrefix(word, "#"):
+		c.report.Comments++
+		return "", false
+	}
+
+	key := CanonicalKey(word)
+	if seen, ok := c.first[key]; ok {
+		if seen == "" {
+			seen = key
+		}
+		if seen == word {
+			c.report.Duplicates++
+		} else {
+			c.report.CaseVariants++
+		}
+		return "", false
+	}
+	if word == key {
+		c.first[key] = ""
+	} else {
+		c.first[key] = word
+	}
+
+	if word != line {
+		c.report.Normalized++
+	}
+	c.report.Kept++
+	return word, true
+}
+
+// WordlistFiles returns the files listed in WORDLIST_FILES, or
+// DEFAULT_WORDLIST.
+func WordlistFiles() []string {
+	files := common.GetEnvList("WORDLIST_FILES")
+	if len(files) == 0 {
+		return []string{DEFAULT_WORDLIST}
+	}
+	return files
+}
@@ -0,0 +1,451 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package lema
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/database"
+	"kbbi-scraper/internal/kbbi"
+	"kbbi-scraper/internal/pause"
+	"kbbi-scraper/internal/proxy"
+
+	"github.com/fatih/color"
+	"github.com/jmoiron/sqlx"
+)
+
+type Outcome string
+
+const (
+	OutcomeDone     Outcome = "done"
+	OutcomeNoResult Outcome = "no-result"
+	OutcomeSkipped  Outcome = "skipped"
+	OutcomeFailed   Outcome = "failed"
+)
+
+const maxPrintedFailures = 20
+
+// DEFAULT_MAX_ATTEMPTS is how many runs may fail on a word before its job
+// is dead-lettered.
+const DEFAULT_MAX_ATTEMPTS = 3
+
+// DEFAULT_LEASE is how long a job stays with a process that stopped
+// sending heartbeats before another process may take it over.
+const DEFAULT_LEASE = 5 * time.Minute
+
+// WordResult is what a worker reports back for one word.
+type WordResult struct {
+	Word     string
+	Outcome  Outcome
+	Provider string
+	Err      error
+	Duration time.Duration
+
+	jobStatus string
+}
+
+// Summary describes a finished ProcessBatch run. AlreadyDone counts the
+// words filtered out before the run and NotStarted the words left in the
+// queue when the run was stopped early.
+type Summary struct {
+	Total       int
+	AlreadyDone int
+	Completed   int
+	NoResult    int
+	Skipped     int
+	Failed      int
+	NotStarted  int
+	Duration    time.Duration
+	StopReason  error
+	Failures    []WordResult
+}
+
+func (s *Summary) Processed() int {
+	return s.Completed + s.NoResult + s.Skipped + s.Failed
+}
+
+func (s *Summary) add(result WordResult) {
+	switch result.Outcome {
+	case OutcomeDone:
+		s.Completed++
+	case OutcomeNoResult:
+		s.NoResult++
+	case OutcomeSkipped:
+		s.Skipped++
+	case OutcomeFailed:
+		s.Failed++
+		s.Failures = append(s.Failures, result)
+	}
+}
+
+func (s *Summary) Print() {
+	common.PrintInfo("Run summary:")
+	common.Printf("  total=%d already_done=%d completed=%d no_result=%d skipped=%d failed=%d not_started=%d\n",
+		s.Total, s.AlreadyDone, s.Completed, s.NoResult, s.Skipped, s.Failed, s.NotStarted)
+	common.Printf("  duration=%v", s.Duration.Round(time.Second))
+	if s.Duration > 0 {
+		common.Printf(" rate=%.2f words/s", float64(s.Processed())/s.Duration.Seconds())
+	}
+	common.Printf("\n")
+
+	if s.StopReason != nil {
+		common.PrintError("Run stopped: %v", s.StopReason)
+	}
+
+	for i, failure := range s.Failures {
+		if i == maxPrintedFailures {
+			common.PrintError("  ... and %d more, see error.log", len(s.Failures)-i)
+			break
+		}
+		common.PrintError("  %s: %v", failure.Word, failure.Err)
+	}
+}
+
+// Monitor follows a run as it goes, e.g. to draw a dashboard. Result is
+// called from a single goroutine with the summary so far.
+type Monitor interface {
+	Start(total int, opts kbbi.SearchOptions)
+	Result(summary Summary, result WordResult)
+	Stop()
+}
+
+var monitor Monitor
+
+// SetMonitor reports every following run to m. A nil m turns it off.
+func SetMonitor(m Monitor) {
+	monitor = m
+}
+
+// stopReason tells the dispatcher whether the run has to end before the
+// queue is empty.
+func stopReason(opts kbbi.SearchOptions) error {
+	if opts.Ledger != nil && opts.Ledger.Exceeded() {
+		return proxy.ErrCreditBudgetReached
+	}
+	if kbbi.DailyCapReached() {
+		return kbbi.ErrDailyCapReached
+	}
+	return nil
+}
+
+// jobSettings says how workers claim and record jobs.
+type jobSettings struct {
+	owner       string
+	lease       time.Duration
+	maxAttempts int
+	// leased is set when the words come from LeaseJobs and are claimed
+	// already.
+	leased bool
+}
+
+func loadJobSettings(leased bool) jobSettings {
+	lease := common.GetEnvDuration("JOB_LEASE", DEFAULT_LEASE)
+	if lease < time.Minute {
+		lease = time.Minute
+	}
+
+	return jobSettings{
+		owner:       database.NewLeaseOwner(),
+		lease:       lease,
+		maxAttempts: common.GetEnvInt("JOB_MAX_ATTEMPTS", DEFAULT_MAX_ATTEMPTS),
+		leased:      leased,
+	}
+}
+
+// ProcessBatch scrapes words with concurrency workers, claiming each word
+// in the jobs table first. Words already done are settled and skipped, and
+// batchSize bounds how far the dispatcher runs ahead of the workers. Both
+// hold while the run is paused.
+func ProcessBatch(words []string, batchSize int, concurrency int, db *sqlx.DB, opts kbbi.SearchOptions) Summary {
+	completed, err := LoadCompleted(db)
+	if err != nil {
+		return Summary{Total: len(words), NotStarted: len(words), StopReason: err}
+	}
+
+	todo, done, noResult := completed.Filter(words)
+	common.PrintInfo("%d to do / %d already done (%d scraped, %d no result)", len(todo), len(done)+len(noResult), len(done), len(noResult))
+
+	if err := database.SettleJobs(db, done, database.JobDone); err != nil {
+		common.PrintError("%v", err)
+	}
+	if err := database.SettleJobs(db, noResult, database.JobNoResult); err != nil {
+		common.PrintError("%v", err)
+	}
+
+	words = todo
+	next := 0
+	source := func(n int) ([]string, error) {
+		end := min(next+n, len(words))
+		batch := words[next:end]
+		next = end
+		return batch, nil
+	}
+
+	summary := run(source, len(words), batchSize, concurrency, db, opts, loadJobSettings(false), completed)
+	summary.AlreadyDone = len(done) + len(noResult)
+	summary.Total += summary.AlreadyDone
+	return summary
+}
+
+// ProcessQueue works through the jobs table instead of a word list, leasing
+// batchSize words at a time, so several processes on different machines
+// can share one run through the same database.
+func ProcessQueue(batchSize int, concurrency int, db *sqlx.DB, opts kbbi.SearchOptions) Summary {
+	open, err := database.CountOpenJobs(db)
+	if err != nil {
+		return Summary{StopReason: fmt.Errorf("error counting jobs: %w", err)}
+	}
+
+	completed, err := LoadCompleted(db)
+	if err != nil {
+		return Summary{StopReason: err}
+	}
+
+	settings := loadJobSettings(true)
+	common.PrintInfo("Leasing from %d open jobs as %s", open, settings.owner)
+
+	source := func(n int) ([]string, error) {
+		return database.LeaseJobs(db, settings.owner, n, settings.lease)
+	}
+
+	summary := run(source, open, batchSize, concurrency, db, opts, settings, completed)
+	summary.Total = summary.Processed() + summary.NotStarted
+	return summary
+}
+
+// ProcessStream scrapes the words of source as they are read, so the list
+// never has to fit in memory; only the canonical key of each distinct word
+// is kept. Lines go through the same cleaning as CleanWordlist, words
+// outside shard or finished before are dropped, and each batch is queued
+// in the jobs table just before it is handed out. The length of the stream
+// is not known, so NotStarted stays zero when the run stops early.
+func ProcessStream(source WordSource, shard Shard, batchSize int, concurrency int, db *sqlx.DB, opts kbbi.SearchOptions) (Summary, WordlistReport) {
+	completed, err := LoadCompleted(db)
+	if err != nil {
+		return Summary{StopReason: err}, WordlistReport{}
+	}
+
+	c := newCleaner()
+	var alreadyDone int
+	next := func(n int) ([]string, error) {
+		var batch, done, noResult []string
+		for len(batch) < n {
+			line, err := source.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			word, ok := c.add(line)
+			if !ok || !shard.Contains(word) {
+				continue
+			}
+			switch completed.Status(word) {
+			case database.JobDone:
+				done = append(done, word)
+			case database.JobNoResult:
+				noResult = append(noResult, word)
+			default:
+				batch = append(batch, word)
+			}
+		}
+
+		alreadyDone += len(done) + len(noResult)
+		if err := database.SettleJobs(db, done, database.JobDone); err != nil {
+			return nil, err
+		}
+		if err := database.SettleJobs(db, noResult, database.JobNoResult); err != nil {
+			return nil, err
+		}
+		if err := database.EnqueueJobs(db, batch); err != nil {
+			return nil, err
+		}
+		return batch, nil
+	}
+
+	summary := run(next, 0, batchSize, concurrency, db, opts, loadJobSettings(false), completed)
+	summary.AlreadyDone = alreadyDone
+	summary.Total = summary.Processed() + summary.AlreadyDone
+	return summary, c.report
+}
+
+// run feeds the words source hands out, batchSize at a time, to the
+// workers until it runs dry or the run has to stop. total is only used for
+// progress output and is zero when it is not known.
+func run(source func(n int) ([]string, error), total int, batchSize int, concurrency int, db *sqlx.DB, opts kbbi.SearchOptions, settings jobSettings, completed *Completed) Summary {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if batchSize < concurrency {
+		batchSize = concurrency
+	}
+
+	start := time.Now()
+	summary := Summary{Total: total}
+
+	if monitor != nil {
+		monitor.Start(total, opts)
+		defer monitor.Stop()
+	}
+
+	jobs := make(chan string, batchSize)
+	results := make(chan WordResult, batchSize)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for word := range jobs {
+				pause.Wait()
+				results <- processWord(word, db, opts, settings, completed)
+			}
+		}()
+	}
+
+	// Claimed words are only recorded when they finish, so the jobs table
+	// is consistent while paused and the process may be stopped there.
+	removeHook := pause.OnChange(func(paused bool) {
+		if paused {
+			common.PrintInfo("Progress is kept in the jobs table, the run can be stopped while paused and started again later")
+		}
+	})
+	defer removeHook()
+
+	stopHeartbeat := make(chan struct{})
+	go heartbeat(db, settings, stopHeartbeat)
+
+	halt := make(chan struct{})
+	var haltOnce sync.Once
+	var haltErr error
+
+	var stopped error
+	var dispatched int
+	go func() {
+		defer close(jobs)
+		for {
+			batch, err := source(batchSize)
+			if err != nil {
+				stopped = err
+				return
+			}
+			if len(batch) == 0 {
+				return
+			}
+
+			for _, word := range batch {
+				if stopped = stopReason(opts); stopped != nil {
+					return
+				}
+				if pause.WaitOr(halt) {
+					stopped = haltErr
+					return
+				}
+				select {
+				case jobs <- word:
+					dispatched++
+				case <-halt:
+					stopped = haltErr
+					return
+				}
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		summary.add(result)
+		progress := fmt.Sprint(summary.Processed())
+		if summary.Total > 0 {
+			progress += fmt.Sprintf("/%d", summary.Total)
+		}
+		common.PrintCustom("[PROGRESS] %s words processed (ok=%d, no result=%d, skipped=%d, failed=%d)", color.FgCyan, true,
+			progress, summary.Completed, summary.NoResult, summary.Skipped, summary.Failed)
+		if monitor != nil {
+			monitor.Result(summary, result)
+		}
+
+		if isFatal(result.Err, opts) {
+			haltOnce.Do(func() {
+				haltErr = result.Err
+				close(halt)
+			})
+		}
+	}
+	close(stopHeartbeat)
+
+	// Leased words the dispatcher never handed out go back to the queue.
+	released, err := database.ReleaseLeases(db, settings.owner)
+	if err != nil {
+		common.PrintError("Error releasing job leases: %v", err)
+	}
+
+	// jobs is closed before results, so the dispatcher is done by now.
+	if settings.leased {
+		summary.NotStarted = int(released)
+	} else if summary.Total > 0 {
+		summary.NotStarted = summary.Total - dispatched
+	}
+	summary.StopReason = stopped
+	summary.Duration = time.Since(start)
+
+	return summary
+}
+
+// heartbeat renews the leases of settings.owner until stop is closed, so
+// slow words are not taken over by another process.
+func heartbeat(db *sqlx.DB, settings jobSettings, stop <-chan struct{}) {
+	ticker := time.NewTicker(settings.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := database.ExtendLeases(db, settings.owner, settings.lease); err != nil {
+				common.PrintError("Error renewing job leases: %v", err)
+			}
+		}
+	}
+}
+
+// isFatal reports whether err means no further word can be scraped in this
+// run, such as every account reaching its daily limit or every provider
+// circuit being open. Without a proxy the KBBI limit page is about our own
+// IP, so it ends the run as well.
+func isFatal(err error, opts kbbi.SearchOptions) bool {
+	if opts.OptionProxy == "" && errors.Is(err, kbbi.ErrLimitReached) {
+		return true
+	}
+	return errors.Is(err, kbbi.ErrNoAccountAvailable) ||
+		errors.Is(err, proxy.ErrCreditBudgetReached) ||
+		errors.Is(err, proxy.ErrAllProvidersOpen) ||
+		errors.Is(err, kbbi.ErrDailyCapReached)
+}
@@ -0,0 +1,249 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package kbbi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/proxy"
+
+	"github.com/temoto/robotstxt"
+)
+
+const (
+	KBBI_ROBOTS_URL    = "https://kbbi.kemdikbud.go.id/robots.txt"
+	REQUEST_QUOTA_FILE = "request_quota.json"
+)
+
+var (
+	ErrDisallowedByRobots = errors.New("disallowed by robots.txt")
+	ErrDailyCapReached    = errors.New("daily request cap reached")
+)
+
+type requestQuota struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// Politeness implements the opt-in polite mode: it honours robots.txt and
+// its Crawl-delay for the KBBI host, identifies us with a contact
+// User-Agent and stops after a daily number of requests.
+type Politeness struct {
+	UserAgent string
+	DailyCap  int
+
+	mu         sync.Mutex
+	group      *robotstxt.Group
+	crawlDelay time.Duration
+	nextAt     time.Time
+	quota      requestQuota
+}
+
+var politeness *Politeness
+
+// LoadPoliteness returns nil unless POLITE_MODE is enabled. It requires
+// CONTACT_USER_AGENT so every request can be traced back to us.
+func LoadPoliteness() (*Politeness, error) {
+	if !common.GetEnvBool("POLITE_MODE", false) {
+		return nil, nil
+	}
+
+	userAgent := os.Getenv("CONTACT_USER_AGENT")
+	if userAgent == "" {
+		return nil, fmt.Errorf("POLITE_MODE requires CONTACT_USER_AGENT, e.g. \"kbbi-scraper (+mailto:you@example.org)\"")
+	}
+
+	p := &Politeness{
+		UserAgent:  userAgent,
+		DailyCap:   common.GetEnvInt("DAILY_REQUEST_CAP", 0),
+		crawlDelay: common.GetEnvDuration("POLITE_MIN_DELAY", time.Second),
+	}
+
+	if err := p.fetchRobots(); err != nil {
+		return nil, err
+	}
+
+	p.loadQuota()
+	return p, nil
+}
+
+// robotsTransport records the robots.txt fetch with the rest of the traffic,
+// and replays it from the capture file instead of asking KBBI.
+func robotsTransport() http.RoundTripper {
+	var rt http.RoundTripper = newBaseTransport(nil)
+	if capture != nil {
+		rt = capture.Transport(rt, proxy.DIRECT)
+	}
+	return rt
+}
+
+func SetPoliteness(p *Politeness) {
+	politeness = p
+}
+
+func (p *Politeness) fetchRobots() error {
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: robotsTransport(),
+	}
+	req, err := http.NewRequest("GET", KBBI_ROBOTS_URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", p.UserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching robots.txt: %w", err)
+	}
+	defer resp.Body.Close()
+
+	robots, err := robotstxt.FromResponse(resp)
+	if err != nil {
+		return fmt.Errorf("error parsing robots.txt: %w", err)
+	}
+
+	p.group = robots.FindGroup(p.UserAgent)
+	if p.group != nil && p.group.CrawlDelay > p.crawlDelay {
+		p.crawlDelay = p.group.CrawlDelay
+	}
+
+	common.PrintInfo("Polite mode: crawl delay %v, daily cap %d", p.crawlDelay, p.DailyCap)
+	return nil
+}
+
+// Before is called ahead of every request to target. It refuses paths that
+// robots.txt disallows or that would exceed the daily cap, and otherwise
+// blocks until the crawl delay since the previous request has passed.
+func (p *Politeness) Before(target *url.URL) error {
+	canonical := common.CanonicalKBBIURL(target)
+	if canonical == nil {
+		return nil
+	}
+
+	if p.group != nil && !p.group.Test(canonical.EscapedPath()) {
+		return fmt.Errorf("%s: %w", canonical.Path, ErrDisallowedByRobots)
+	}
+
+	p.mu.Lock()
+	if day := today(); p.quota.Date != day {
+		p.quota = requestQuota{Date: day}
+	}
+	if p.DailyCap > 0 && p.quota.Count >= p.DailyCap {
+		p.mu.Unlock()
+		return ErrDailyCapReached
+	}
+	p.quota.Count++
+	p.saveQuota()
+
+	wait := time.Until(p.nextAt)
+	if wait < 0 {
+		wait = 0
+	}
+	p.nextAt = time.Now().Add(wait + p.crawlDelay)
+	p.mu.Unlock()
+
+	time.Sleep(wait)
+	return nil
+}
+
+func (p *Politeness) loadQuota() {
+	data, err := os.ReadFile(REQUEST_QUOTA_FILE)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading request quota file: %v", err)
+		}
+		return
+	}
+
+	var quota requestQuota
+	if err := json.Unmarshal(data, &quota); err != nil {
+		log.Printf("Error unmarshaling request quota: %v", err)
+		return
+	}
+
+	if quota.Date == today() {
+		p.quota = quota
+	}
+}
+
+func (p *Politeness) saveQuota() {
+	data, err := json.Marshal(p.quota)
+	if err != nil {
+		log.Printf("Error marshaling request quota: %v", err)
+		return
+	}
+
+	if err := os.WriteFile(REQUEST_QUOTA_FILE, data, 0644); err != nil {
+		log.Printf("Error saving request quota: %v", err)
+	}
+}
+
+// PoliteMode reports whether polite mode is on.
+func PoliteMode() bool {
+	return politeness != nil
+}
+
+// DailyCapReached reports whether polite mode has used up today's requests.
+func DailyCapReached() bool {
+	if politeness == nil || politeness.DailyCap <= 0 {
+		return false
+	}
+
+	politeness.mu.Lock()
+	defer politeness.mu.Unlock()
+	return politeness.quota.Date == today() && politeness.quota.Count >= politeness.DailyCap
+}
+
+// DailyQuota returns the requests polite mode has counted today and its
+// daily cap. The cap is zero when polite mode or the cap is off.
+func DailyQuota() (used, limit int) {
+	if politeness == nil {
+		return 0, 0
+	}
+
+	politeness.mu.Lock()
+	defer politeness.mu.Unlock()
+	if politeness.quota.Date == today() {
+		used = politeness.quota.Count
+	}
+	return used, politeness.DailyCap
+}
+
+// politeTransport runs every request through Politeness.Before. It sits
+// below the response cache so cached pages cost neither quota nor delay.
+type politeTransport struct {
+	politeness *Politeness
+	next       http.RoundTripper
+}
+
+func (t *politeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.politeness.Before(req.URL); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
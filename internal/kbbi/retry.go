@@ -0,0 +1,352 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package kbbi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kbbi-scraper/internal/common"
+)
+
+type ErrorClass string
+
+const (
+	ErrorClassEOF       ErrorClass = "eof"
+	ErrorClassTimeout   ErrorClass = "timeout"
+	ErrorClassServer    ErrorClass = "server"
+	ErrorClassRateLimit ErrorClass = "rate_limit"
+	ErrorClassLimit     ErrorClass = "limit"
+	ErrorClassClient    ErrorClass = "client"
+	ErrorClassOther     ErrorClass = "other"
+)
+
+var (
+	ErrLimitReached = errors.New("limit reached")
+	// ErrParseFailed means the page was neither an entry nor a not-found
+	// page, usually a layout change or an error page from a proxy.
+	ErrParseFailed = errors.New("page could not be parsed")
+)
+
+type HTTPError struct {
+	StatusCode int
+	URL        string
+	Detail     string
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.URL, e.StatusCode, e.Detail)
+}
+
+type RetryOverride struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+}
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Multiplier  float64
+	Jitter      float64
+	Retryable   map[ErrorClass]bool
+	Overrides   map[ErrorClass]RetryOverride
+}
+
+var (
+	retryPolicyMu sync.RWMutex
+	retryPolicy   = DefaultRetryPolicy()
+)
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   5 * time.Second,
+		MaxDelay:    time.Minute,
+		Multiplier:  2,
+		Jitter:      0.2,
+		Retryable: map[ErrorClass]bool{
+			ErrorClassEOF:       true,
+			ErrorClassTimeout:   true,
+			ErrorClassServer:    true,
+			ErrorClassRateLimit: true,
+		},
+		Overrides: map[ErrorClass]RetryOverride{},
+	}
+}
+
+// LoadRetryPolicy builds the retry policy from the RETRY_* environment
+// variables, falling back to DefaultRetryPolicy for anything unset.
+//
+// RETRY_OVERRIDES takes entries of the form class:attempts[:delay], for
+// example "rate_limit:5:30s,timeout:4".
+func LoadRetryPolicy() RetryPolicy {
+	p := DefaultRetryPolicy()
+	p.MaxAttempts = common.GetEnvInt("RETRY_MAX_ATTEMPTS", p.MaxAttempts)
+	p.BaseDelay = common.GetEnvDuration("RETRY_BASE_DELAY", p.BaseDelay)
+	p.MaxDelay = common.GetEnvDuration("RETRY_MAX_DELAY", p.MaxDelay)
+	p.Multiplier = common.GetEnvFloat("RETRY_MULTIPLIER", p.Multiplier)
+	p.Jitter = common.GetEnvFloat("RETRY_JITTER", p.Jitter)
+
+	if classes := common.GetEnvList("RETRY_ON"); len(classes) > 0 {
+		p.Retryable = map[ErrorClass]bool{}
+		for _, class := range classes {
+			p.Retryable[ErrorClass(strings.ToLower(class))] = true
+		}
+	}
+
+	for _, entry := range common.GetEnvList("RETRY_OVERRIDES") {
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 {
+			common.PrintWarning("Invalid retry override %q", entry)
+			continue
+		}
+
+		attempts, err := strconv.Atoi(parts[1])
+		if err != nil {
+			common.PrintWarning("Invalid retry override %q: %v", entry, err)
+			continue
+		}
+
+		override := RetryOverride{MaxAttempts: attempts}
+		if len(parts) > 2 {
+			delay, err := time.ParseDuration(parts[2])
+			if err != nil {
+				common.PrintWarning("Invalid retry override %q: %v", entry, err)
+				continue
+			}
+			override.BaseDelay = delay
+		}
+
+		class := ErrorClass(strings.ToLower(parts[0]))
+		p.Overrides[class] = override
+		p.Retryable[class] = attempts > 1
+	}
+
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+
+	return p
+}
+
+func SetRetryPolicy(p RetryPolicy) {
+	retryPolicyMu.Lock()
+	defer retryPolicyMu.Unlock()
+	retryPolicy = p
+}
+
+func GetRetryPolicy() RetryPolicy {
+	retryPolicyMu.RLock()
+	defer retryPolicyMu.RUnlock()
+	return retryPolicy
+}
+
+func (p RetryPolicy) attemptsFor(class ErrorClass) int {
+	if override, ok := p.Overrides[class]; ok && override.MaxAttempts > 0 {
+		return override.MaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) delayFor(class ErrorClass, attempt int, err error) time.Duration {
+	// Retry-After is honoured up to MaxDelay, so a server asking for a day
+	// cannot stall a worker that long.
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.RetryAfter > 0 {
+		if p.MaxDelay > 0 && httpErr.RetryAfter > p.MaxDelay {
+			return p.MaxDelay
+		}
+		return httpErr.RetryAfter
+	}
+
+	base := p.BaseDelay
+	if override, ok := p.Overrides[class]; ok && override.BaseDelay > 0 {
+		base = override.BaseDelay
+	}
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(base) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(delay)
+}
+
+// Do runs fn until it succeeds, returns an error whose class is not
+// retryable, or runs out of attempts for that class.
+func (p RetryPolicy) Do(label string, fn func(attempt int) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil {
+			return nil
+		}
+
+		class := ClassifyError(err)
+		maxAttempts := p.attemptsFor(class)
+		if !p.Retryable[class] || attempt >= maxAttempts {
+			return err
+		}
+
+		delay := p.delayFor(class, attempt, err)
+		common.PrintError("%s: %s error occurred. Retrying in %v... (Attempt %d/%d)", label, class, delay.Round(time.Millisecond), attempt, maxAttempts)
+		time.Sleep(delay)
+	}
+}
+
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+
+	if errors.Is(err, ErrLimitReached) {
+		return ErrorClassLimit
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode == http.StatusTooManyRequests:
+			return ErrorClassRateLimit
+		case httpErr.StatusCode == http.StatusRequestTimeout || httpErr.StatusCode == http.StatusGatewayTimeout:
+			return ErrorClassTimeout
+		case httpErr.StatusCode >= 500:
+			return ErrorClassServer
+		case httpErr.StatusCode >= 400:
+			return ErrorClassClient
+		}
+	}
+
+	if isTimeout(err) {
+		return ErrorClassTimeout
+	}
+
+	if isEOF(err) {
+		return ErrorClassEOF
+	}
+
+	return ErrorClassOther
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	errString := err.Error()
+	return strings.Contains(errString, "Client.Timeout") || strings.Contains(errString, "i/o timeout")
+}
+
+func isEOF(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	errString := err.Error()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.Contains(errString, "EOF") ||
+		strings.Contains(errString, "connection reset by peer") ||
+		strings.Contains(errString, "broken pipe") ||
+		strings.Contains(errString, "use of closed network connection") {
+		return true
+	}
+
+	if netErr, ok := err.(*net.OpError); ok {
+		if netErr.Err != nil && strings.Contains(netErr.Err.Error(), "EOF") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isProxyFailure reports whether err points at the proxy rather than at
+// KBBI or the page: a timeout, a dropped or refused connection, or 407.
+func isProxyFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusProxyAuthRequired
+	}
+
+	if isTimeout(err) || isEOF(err) {
+		return true
+	}
+
+	errString := err.Error()
+	return strings.Contains(errString, "connection refused") ||
+		strings.Contains(errString, "Proxy Authentication Required")
+}
+
+// blamesProxy reports whether err should eject the proxy the request went
+// through: a proxy failure, the banned redirect, or the daily limit when no
+// account is logged in, as KBBI then counts the limit per IP.
+func blamesProxy(err error, cookie string) bool {
+	if errors.Is(err, ErrAccountBanned) {
+		return true
+	}
+	if errors.Is(err, ErrLimitReached) {
+		return cookie == ""
+	}
+	return isProxyFailure(err)
+}
+
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
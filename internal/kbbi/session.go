@@ -0,0 +1,172 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package kbbi
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/proxy"
+
+	"github.com/gocolly/colly/v2"
+)
+
+const KBBI_COOKIE_NAME = common.KBBI_COOKIE_NAME
+
+var (
+	ErrSessionExpired = errors.New("session expired")
+	ErrAccountBanned  = errors.New("account is banned")
+)
+
+// SessionManager owns the KBBI login of one account. It logs in lazily,
+// persists the cookie to its session file and logs in again when a search
+// reports the cookie as expired.
+type SessionManager struct {
+	mu       sync.Mutex
+	email    string
+	password string
+	cookie   string
+	file     string
+	profile  common.HeaderProfile
+	sticky   proxy.StickySession
+	proxies  *proxy.Pool
+}
+
+func NewSessionManager(email, password string) *SessionManager {
+	return newSessionManager(email, password, common.SESSION_FILE)
+}
+
+func newSessionManager(email, password, file string) *SessionManager {
+	s := &SessionManager{
+		email:    email,
+		password: password,
+		file:     file,
+	}
+
+	saved := common.LoadSessionFile(file)
+	if saved.Email == email && saved.Cookie != "" {
+		s.cookie = saved.Cookie
+	}
+
+	return s
+}
+
+// NewSessionManagerFromFile restores the account stored in the session file.
+func NewSessionManagerFromFile() (*SessionManager, error) {
+	saved := common.LoadSession()
+	if saved.Email == "" || saved.Password == "" {
+		return nil, fmt.Errorf("no saved session in %s", common.SESSION_FILE)
+	}
+
+	return &SessionManager{
+		email:    saved.Email,
+		password: saved.Password,
+		cookie:   saved.Cookie,
+		file:     common.SESSION_FILE,
+	}, nil
+}
+
+func (s *SessionManager) Email() string {
+	return s.email
+}
+
+// HeaderProfile returns the browser headers this session always presents.
+func (s *SessionManager) HeaderProfile() common.HeaderProfile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.headerProfileLocked()
+}
+
+func (s *SessionManager) headerProfileLocked() common.HeaderProfile {
+	if s.profile == nil {
+		s.profile = common.RandomHeaderProfile()
+	}
+	return s.profile
+}
+
+// Sticky returns the session ID source that pins the exit IP of this
+// session's login and searches.
+func (s *SessionManager) Sticky() *proxy.StickySession {
+	return &s.sticky
+}
+
+// useProxies makes the next login go through pool, so that with sticky
+// rotation it leaves from the same IP as the searches.
+func (s *SessionManager) useProxies(pool *proxy.Pool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proxies = pool
+}
+
+// Cookie returns the current session cookie, logging in first if there is none.
+func (s *SessionManager) Cookie() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cookie != "" {
+		return s.cookie, nil
+	}
+
+	if err := s.login(); err != nil {
+		return "", err
+	}
+
+	return s.cookie, nil
+}
+
+// Refresh logs in again unless another caller already replaced the stale
+// cookie, so concurrent searches hitting an expired session only trigger
+// one login.
+func (s *SessionManager) Refresh(stale string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cookie != "" && s.cookie != stale {
+		return nil
+	}
+
+	return s.login()
+}
+
+func (s *SessionManager) login() error {
+	common.PrintInfo("Logging in to KBBI as %s", s.email)
+
+	var proxyFunc colly.ProxyFunc
+	if s.proxies != nil {
+		if session := s.proxies.SessionID(&s.sticky); session != "" {
+			proxyFunc = s.proxies.ProxyFunc(session)
+		}
+	}
+
+	result, err := loginKBBI(s.email, s.password, s.headerProfileLocked(), proxyFunc)
+	if err != nil {
+		s.cookie = ""
+		return fmt.Errorf("login %s: %w", s.email, err)
+	}
+
+	s.cookie = result.Cookie
+	common.SaveSessionFile(s.file, common.Session{
+		Email:    s.email,
+		Password: s.password,
+		Cookie:   s.cookie,
+	})
+
+	return nil
+}
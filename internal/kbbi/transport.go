@@ -0,0 +1,316 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package kbbi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"kbbi-scraper/internal/common"
+	"kbbi-scraper/internal/httpcache"
+	"kbbi-scraper/internal/recorder"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly/v2"
+)
+
+// TransportConfig holds the TLS and egress settings of every collector.
+type TransportConfig struct {
+	InsecureSkipVerify    bool
+	CAFile                string
+	BindAddresses         []net.IP
+	UseEnvProxy           bool
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	RequestTimeout        time.Duration
+	Compression           bool
+	MaxResponseBytes      int64
+}
+
+var (
+	transportConfig = TransportConfig{
+		UseEnvProxy:         true,
+		DialTimeout:         30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		RequestTimeout:      60 * time.Second,
+		Compression:         true,
+	}
+	tlsConfig = &tls.Config{}
+	bindIndex atomic.Uint64
+)
+
+// LoadTransportConfig reads the TLS_*, BIND_* and *_TIMEOUT variables,
+// HTTP_COMPRESSION and MAX_RESPONSE_BYTES. Certificates are verified unless
+// TLS_INSECURE_SKIP_VERIFY is set, and HTTP_PROXY/HTTPS_PROXY are honoured
+// unless USE_ENV_PROXY=false.
+func LoadTransportConfig() (TransportConfig, error) {
+	config := transportConfig
+	config.InsecureSkipVerify = common.GetEnvBool("TLS_INSECURE_SKIP_VERIFY", false)
+	config.CAFile = os.Getenv("TLS_CA_FILE")
+	config.UseEnvProxy = common.GetEnvBool("USE_ENV_PROXY", config.UseEnvProxy)
+	config.DialTimeout = common.GetEnvDuration("DIAL_TIMEOUT", config.DialTimeout)
+	config.TLSHandshakeTimeout = common.GetEnvDuration("TLS_HANDSHAKE_TIMEOUT", config.TLSHandshakeTimeout)
+	config.ResponseHeaderTimeout = common.GetEnvDuration("RESPONSE_HEADER_TIMEOUT", config.ResponseHeaderTimeout)
+	config.RequestTimeout = common.GetEnvDuration("REQUEST_TIMEOUT", config.RequestTimeout)
+	config.Compression = common.GetEnvBool("HTTP_COMPRESSION", config.Compression)
+	config.MaxResponseBytes = int64(common.GetEnvInt("MAX_RESPONSE_BYTES", 0))
+
+	for _, address := range common.GetEnvList("BIND_ADDRESSES") {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return config, fmt.Errorf("invalid bind address %q", address)
+		}
+		config.BindAddresses = append(config.BindAddresses, ip)
+	}
+
+	if name := os.Getenv("BIND_INTERFACE"); name != "" {
+		ips, err := interfaceAddresses(name)
+		if err != nil {
+			return config, err
+		}
+		config.BindAddresses = append(config.BindAddresses, ips...)
+	}
+
+	return config, nil
+}
+
+func interfaceAddresses(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("error finding interface %s: %w", name, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("error reading addresses of %s: %w", name, err)
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("interface %s has no usable address", name)
+	}
+	return ips, nil
+}
+
+func SetTransportConfig(config TransportConfig) error {
+	tc := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return fmt.Errorf("error reading CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	if config.InsecureSkipVerify {
+		common.PrintWarning("TLS certificate verification is disabled")
+	}
+
+	transportConfig = config
+	tlsConfig = tc
+	return nil
+}
+
+// newBaseTransport is the innermost transport. With bind addresses set,
+// every new connection leaves from the next local address in turn.
+func newBaseTransport(proxyFunc func(*http.Request) (*url.URL, error)) *http.Transport {
+	config := transportConfig
+
+	if proxyFunc == nil && config.UseEnvProxy {
+		proxyFunc = http.ProxyFromEnvironment
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	dialContext := dialer.DialContext
+	if len(config.BindAddresses) > 0 {
+		dialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			ip := config.BindAddresses[bindIndex.Add(1)%uint64(len(config.BindAddresses))]
+			bound := *dialer
+			bound.LocalAddr = &net.TCPAddr{IP: ip}
+
+			// Stick to the family of the local address so the resolver
+			// does not hand us a destination we cannot reach from it.
+			if ip.To4() != nil {
+				network = "tcp4"
+			} else {
+				network = "tcp6"
+			}
+			return bound.DialContext(ctx, network, address)
+		}
+	}
+
+	return &http.Transport{
+		Proxy:                 proxyFunc,
+		DialContext:           dialContext,
+		TLSClientConfig:       tlsConfig.Clone(),
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+		DisableCompression:    !config.Compression,
+	}
+}
+
+// HealthTransport is the transport for health checks through proxyURL, with
+// the same dial and TLS settings as the scraper.
+func HealthTransport(proxyURL *url.URL) http.RoundTripper {
+	return newBaseTransport(http.ProxyURL(proxyURL))
+}
+
+var (
+	responseCache *httpcache.Cache
+	capture       *recorder.Recorder
+)
+
+// SetRecorder records or replays the traffic of every collector.
+func SetRecorder(r *recorder.Recorder) {
+	capture = r
+}
+
+// Replaying reports whether responses come from a capture file, so nothing
+// may go out over the network.
+func Replaying() bool {
+	return capture != nil && capture.Mode() == recorder.ModeReplay
+}
+
+// SetResponseCache enables the on-disk HTTP cache for every collector.
+func SetResponseCache(c *httpcache.Cache) {
+	if c != nil {
+		c.Cacheable = isCacheablePage
+		c.Storable = isStorablePage
+		c.Session = requestSession
+	}
+	responseCache = c
+}
+
+// NewTransport builds the fetch layer of every collector: cache, polite
+// mode, recorder, metering, then the HTTP transport, which gets the proxy.
+// provider names who serves the requests in captures.
+func NewTransport(proxyFunc func(*http.Request) (*url.URL, error), provider string) http.RoundTripper {
+	var rt http.RoundTripper = &meteredTransport{
+		next:     newBaseTransport(proxyFunc),
+		provider: provider,
+		compress: transportConfig.Compression,
+		maxBytes: transportConfig.MaxResponseBytes,
+	}
+
+	if capture != nil {
+		rt = capture.Transport(rt, provider)
+	}
+
+	if politeness != nil && !Replaying() {
+		rt = &politeTransport{politeness: politeness, next: rt}
+	}
+
+	if responseCache != nil {
+		rt = responseCache.Transport(rt)
+	}
+
+	return rt
+}
+
+// UseTransport installs the fetch layer and the configured request timeout
+// on c.
+func UseTransport(c *colly.Collector, proxyFunc func(*http.Request) (*url.URL, error), provider string) {
+	c.WithTransport(NewTransport(proxyFunc, provider))
+	c.SetRequestTimeout(transportConfig.RequestTimeout)
+}
+
+func isCacheablePage(u *url.URL) bool {
+	path := strings.ToLower(u.Path)
+	return strings.HasPrefix(path, "/entri/") || strings.HasPrefix(path, "/cari/alphabet")
+}
+
+// requestSession returns the KBBI session cookie req carries, in its Cookie
+// header or in a scraping API parameter, or "" when it is logged out.
+func requestSession(req *http.Request) string {
+	if cookie, err := req.Cookie(KBBI_COOKIE_NAME); err == nil {
+		return cookie.Value
+	}
+
+	prefix := KBBI_COOKIE_NAME + "="
+	for _, values := range req.URL.Query() {
+		for _, value := range values {
+			for _, part := range strings.Split(value, ";") {
+				if session, ok := strings.CutPrefix(strings.TrimSpace(part), prefix); ok {
+					return session
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// isStorablePage only lets pages the parsers recognise into the cache: an
+// entry or not-found page, or a page of the alphabet list. Limit pages,
+// provider error bodies and anything else sent with status 200 would
+// otherwise be replayed for the whole TTL.
+func isStorablePage(resp *http.Response, body []byte) bool {
+	if isBannedURL(resp.Request.URL) {
+		return false
+	}
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	if checkBatasHarian(doc.Selection) {
+		return false
+	}
+
+	canonical := common.CanonicalKBBIURL(resp.Request.URL)
+	if canonical == nil {
+		return false
+	}
+	if strings.HasPrefix(strings.ToLower(canonical.Path), "/cari/alphabet") {
+		return doc.Find("#currentPageId, .row .col-md-3 a").Length() > 0
+	}
+
+	content := doc.Find(".body-content")
+	return checkFrasaNotFound(content) || content.Find("h2").Length() > 0
+}
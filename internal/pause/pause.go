@@ -0,0 +1,151 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package pause
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"sync"
+
+	"kbbi-scraper/internal/common"
+)
+
+// The pause state is shared by every loop that hands out work, so one
+// signal or keypress holds the whole process. Requests already sent are
+// not interrupted; loops call Wait before starting the next one.
+var (
+	mu      sync.Mutex
+	paused  bool
+	resumed = make(chan struct{})
+	hooks   = map[int]func(paused bool){}
+	nextID  int
+)
+
+func Paused() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return paused
+}
+
+// Pause holds every loop at its next Wait. reason is shown to the user.
+func Pause(reason string) {
+	mu.Lock()
+	if paused {
+		mu.Unlock()
+		return
+	}
+	paused = true
+	resumed = make(chan struct{})
+	mu.Unlock()
+
+	common.PrintWarning("Paused (%s), requests in flight will finish first", reason)
+	notify(true)
+}
+
+func Resume(reason string) {
+	mu.Lock()
+	if !paused {
+		mu.Unlock()
+		return
+	}
+	paused = false
+	close(resumed)
+	mu.Unlock()
+
+	common.PrintInfo("Resumed (%s)", reason)
+	notify(false)
+}
+
+func Toggle(reason string) {
+	if Paused() {
+		Resume(reason)
+	} else {
+		Pause(reason)
+	}
+}
+
+// Wait blocks while paused.
+func Wait() {
+	WaitOr(nil)
+}
+
+// WaitOr blocks while paused or until done is closed, and reports whether
+// it returned because of done.
+func WaitOr(done <-chan struct{}) bool {
+	mu.Lock()
+	if !paused {
+		mu.Unlock()
+		return false
+	}
+	ch := resumed
+	mu.Unlock()
+
+	select {
+	case <-ch:
+		return false
+	case <-done:
+		return true
+	}
+}
+
+// OnChange calls fn after every pause and resume, e.g. to save state while
+// paused. The returned function removes fn again.
+func OnChange(fn func(paused bool)) (remove func()) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	id := nextID
+	nextID++
+	hooks[id] = fn
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(hooks, id)
+	}
+}
+
+func notify(paused bool) {
+	mu.Lock()
+	fns := make([]func(bool), 0, len(hooks))
+	for _, fn := range hooks {
+		fns = append(fns, fn)
+	}
+	mu.Unlock()
+
+	for _, fn := range fns {
+		fn(paused)
+	}
+}
+
+// ListenKeys toggles the pause on every line read from r: "p" pauses, "r"
+// resumes and an empty line (just Enter) toggles. It returns when r does.
+func ListenKeys(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		switch strings.ToLower(strings.TrimSpace(scanner.Text())) {
+		case "p":
+			Pause("key p")
+		case "r":
+			Resume("key r")
+		case "":
+			Toggle("Enter")
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"kbbi-scraper/internal/common"
+)
+
+type BandwidthUsage struct {
+	Name     string
+	Requests int
+	BytesIn  int64
+	BytesOut int64
+}
+
+// Meter counts the bytes sent and received per provider, so bandwidth
+// billed plans can be estimated before the invoice arrives.
+type Meter struct {
+	mu        sync.Mutex
+	usage     map[string]*BandwidthUsage
+	costPerGB float64
+}
+
+func NewMeter(costPerGB float64) *Meter {
+	return &Meter{
+		usage:     map[string]*BandwidthUsage{},
+		costPerGB: costPerGB,
+	}
+}
+
+// LoadMeter reads the price of a gigabyte from PROXY_COST_PER_GB. Zero
+// leaves the cost out of the summary.
+func LoadMeter() *Meter {
+	return NewMeter(common.GetEnvFloat("PROXY_COST_PER_GB", 0))
+}
+
+func (m *Meter) Record(provider string, in, out int64) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	usage, ok := m.usage[provider]
+	if !ok {
+		usage = &BandwidthUsage{Name: provider}
+		m.usage[provider] = usage
+	}
+	usage.Requests++
+	usage.BytesIn += in
+	usage.BytesOut += out
+}
+
+func (m *Meter) Summary() []BandwidthUsage {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	summary := make([]BandwidthUsage, 0, len(m.usage))
+	for _, usage := range m.usage {
+		summary = append(summary, *usage)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		return summary[i].Name < summary[j].Name
+	})
+	return summary
+}
+
+func (m *Meter) PrintSummary() {
+	summary := m.Summary()
+	if len(summary) == 0 {
+		return
+	}
+
+	var total int64
+	common.PrintInfo("Bandwidth summary:")
+	for _, usage := range summary {
+		bytes := usage.BytesIn + usage.BytesOut
+		total += bytes
+		common.Printf("  %-12s requests=%d in=%s out=%s avg=%s\n", usage.Name, usage.Requests, FormatBytes(usage.BytesIn), FormatBytes(usage.BytesOut), FormatBytes(bytes/int64(usage.Requests)))
+	}
+
+	if m.costPerGB > 0 {
+		common.PrintInfo("Total transfer: %s, estimated cost %.2f", FormatBytes(total), float64(total)/(1<<30)*m.costPerGB)
+	} else {
+		common.PrintInfo("Total transfer: %s", FormatBytes(total))
+	}
+}
+
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,258 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"kbbi-scraper/internal/common"
+)
+
+// DIRECT is the chain entry that fetches KBBI without any provider.
+const DIRECT = "direct"
+
+var ErrAllProvidersOpen = fmt.Errorf("every provider in the failover chain is unavailable")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker stops sending words to a provider after Threshold consecutive
+// failures. Once Cooldown has passed it lets a single probe through and
+// closes again if the probe succeeds.
+type Breaker struct {
+	mu        sync.Mutex
+	name      string
+	threshold int
+	cooldown  time.Duration
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func NewBreaker(name string, threshold int, cooldown time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		common.PrintInfo("Provider %s is half-open, probing", b.name)
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerClosed {
+		common.PrintSuccess("Provider %s recovered", b.name)
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		if b.state != BreakerOpen {
+			common.PrintWarning("Provider %s failed %d times in a row, opening circuit for %v", b.name, b.failures, b.cooldown)
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// release gives back a half-open probe that ended without a verdict.
+func (b *Breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+type ChainStatus struct {
+	Name     string
+	State    BreakerState
+	Failures int
+}
+
+// Chain tries providers in order, skipping those whose breaker is open.
+// A nil provider stands for DIRECT.
+type Chain struct {
+	providers []Provider
+	names     []string
+	breakers  []*Breaker
+}
+
+// NewChain builds a failover chain from provider names; DIRECT may appear
+// anywhere in the list. Duplicate names are dropped.
+func NewChain(names []string, threshold int, cooldown time.Duration) (*Chain, error) {
+	c := &Chain{}
+	seen := map[string]bool{}
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		var p Provider
+		if name != DIRECT {
+			var err error
+			p, err = Get(name)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		c.providers = append(c.providers, p)
+		c.names = append(c.names, name)
+		c.breakers = append(c.breakers, NewBreaker(name, threshold, cooldown))
+	}
+
+	if len(c.providers) == 0 {
+		return nil, fmt.Errorf("failover chain is empty")
+	}
+
+	return c, nil
+}
+
+// LoadChain puts first in front of the PROXY_FAILOVER list.
+func LoadChain(first string) (*Chain, error) {
+	names := append([]string{first}, common.GetEnvList("PROXY_FAILOVER")...)
+	return NewChain(
+		names,
+		common.GetEnvInt("BREAKER_THRESHOLD", 5),
+		common.GetEnvDuration("BREAKER_COOLDOWN", 2*time.Minute),
+	)
+}
+
+// First returns the provider at the head of the chain.
+func (c *Chain) First() Provider {
+	return c.providers[0]
+}
+
+// Do calls fn with each available provider until one succeeds and returns
+// the name of the provider that served the request, or of the last one
+// tried when every provider failed. Errors for which
+// countsAgainst returns false are not the provider's fault and end the
+// chain without tripping its breaker.
+func (c *Chain) Do(fn func(p Provider) error, countsAgainst func(error) bool) (string, error) {
+	var lastErr error
+	var lastName string
+
+	for i, p := range c.providers {
+		breaker := c.breakers[i]
+		if !breaker.Allow() {
+			continue
+		}
+
+		err := fn(p)
+		if err == nil {
+			breaker.Success()
+			return c.names[i], nil
+		}
+
+		if !countsAgainst(err) {
+			breaker.release()
+			return c.names[i], err
+		}
+
+		breaker.Failure()
+		lastErr = err
+		lastName = c.names[i]
+		if i < len(c.providers)-1 {
+			common.PrintWarning("Provider %s failed: %v, failing over", c.names[i], err)
+		}
+	}
+
+	if lastErr == nil {
+		return "", ErrAllProvidersOpen
+	}
+	return lastName, lastErr
+}
+
+func (c *Chain) Status() []ChainStatus {
+	status := make([]ChainStatus, 0, len(c.breakers))
+	for i, b := range c.breakers {
+		b.mu.Lock()
+		status = append(status, ChainStatus{
+			Name:     c.names[i],
+			State:    b.state,
+			Failures: b.failures,
+		})
+		b.mu.Unlock()
+	}
+	return status
+}
@@ -0,0 +1,213 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PROVIDERS_FILE = "proxy_providers.json"
+
+// GenericConfig describes a scraping API that takes the target URL as a
+// query parameter, so new gateways can be added from a config file.
+type GenericConfig struct {
+	Name              string            `json:"name"`
+	Endpoint          string            `json:"endpoint"`
+	URLParam          string            `json:"url_param"`
+	APIKeyEnv         string            `json:"api_key_env"`
+	APIKeyParam       string            `json:"api_key_param"`
+	APIKeyHeader      string            `json:"api_key_header"`
+	Params            map[string]string `json:"params"`
+	CookieParam       string            `json:"cookie_param"`
+	Country           string            `json:"country"`
+	CountryParam      string            `json:"country_param"`
+	SessionParam      string            `json:"session_param"`
+	Rotation          string            `json:"rotation"`
+	StickyTTL         string            `json:"sticky_ttl"`
+	ErrorField        string            `json:"error_field"`
+	ErrorMarker       string            `json:"error_marker"`
+	CreditsHeader     string            `json:"credits_header"`
+	CostHeader        string            `json:"cost_header"`
+	CreditsPerRequest float64           `json:"credits_per_request"`
+	Concurrency       int               `json:"concurrency"`
+	BatchSize         int               `json:"batch_size"`
+}
+
+type Generic struct {
+	config GenericConfig
+	geo    GeoConfig
+}
+
+func NewGeneric(config GenericConfig) (*Generic, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("provider name is required")
+	}
+	if _, err := url.Parse(config.Endpoint); err != nil || config.Endpoint == "" {
+		return nil, fmt.Errorf("provider %s: invalid endpoint %q", config.Name, config.Endpoint)
+	}
+
+	if config.URLParam == "" {
+		config.URLParam = "url"
+	}
+	if config.ErrorField == "" {
+		config.ErrorField = "detail"
+	}
+	if config.CreditsPerRequest <= 0 {
+		config.CreditsPerRequest = 1
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 10 * config.Concurrency
+	}
+
+	geo := GeoConfig{Country: config.Country, Rotation: ROTATE_REQUEST}
+	if config.Rotation != "" {
+		geo.Rotation = config.Rotation
+	}
+	if config.StickyTTL != "" {
+		ttl, err := time.ParseDuration(config.StickyTTL)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: invalid sticky_ttl: %w", config.Name, err)
+		}
+		geo.StickyTTL = ttl
+	}
+
+	g := &Generic{config: config}
+	g.SetGeo(geo)
+	return g, nil
+}
+
+// LoadProviders registers the providers of PROXY_PROVIDERS_FILE (default
+// proxy_providers.json). A missing default file is not an error.
+func LoadProviders() error {
+	path := os.Getenv("PROXY_PROVIDERS_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = PROVIDERS_FILE
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil
+		}
+		return fmt.Errorf("error reading providers file: %w", err)
+	}
+
+	var configs []GenericConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("error parsing providers file: %w", err)
+	}
+
+	for _, config := range configs {
+		p, err := NewGeneric(config)
+		if err != nil {
+			return err
+		}
+		Register(p)
+	}
+
+	return nil
+}
+
+func (p *Generic) Name() string { return p.config.Name }
+
+func (p *Generic) Geo() GeoConfig { return p.geo }
+
+// SetGeo keeps requests rotating when the gateway has no session parameter.
+func (p *Generic) SetGeo(geo GeoConfig) {
+	if p.config.SessionParam == "" {
+		geo.Rotation = ROTATE_REQUEST
+	}
+	p.geo = geo
+}
+
+func (p *Generic) BuildURL(target string, cookie string, session string) (string, error) {
+	params := url.Values{}
+	for key, value := range p.config.Params {
+		params.Set(key, value)
+	}
+	if p.config.APIKeyParam != "" && p.config.APIKeyEnv != "" {
+		params.Set(p.config.APIKeyParam, os.Getenv(p.config.APIKeyEnv))
+	}
+	if cookie != "" && p.config.CookieParam != "" {
+		params.Set(p.config.CookieParam, sessionCookie(cookie))
+	}
+	if p.geo.Country != "" && p.config.CountryParam != "" {
+		params.Set(p.config.CountryParam, p.geo.Country)
+	}
+	if session != "" && p.config.SessionParam != "" {
+		params.Set(p.config.SessionParam, session)
+	}
+	return buildURL(p.config.Endpoint, p.config.URLParam, target, params)
+}
+
+// Header returns the headers the provider needs on every request.
+func (p *Generic) Header() http.Header {
+	header := http.Header{}
+	if p.config.APIKeyHeader != "" && p.config.APIKeyEnv != "" {
+		header.Set(p.config.APIKeyHeader, os.Getenv(p.config.APIKeyEnv))
+	}
+	return header
+}
+
+// Secrets names the query parameters and headers of p that carry the API
+// key or the KBBI cookie.
+func (p *Generic) Secrets() (params, headers []string) {
+	return []string{p.config.APIKeyParam, p.config.CookieParam}, []string{p.config.APIKeyHeader}
+}
+
+func (p *Generic) ParseError(statusCode int, body []byte) string {
+	return parseJSONError(body, p.config.ErrorField)
+}
+
+func (p *Generic) Validate(header http.Header, body []byte) error {
+	if p.config.ErrorMarker != "" && strings.Contains(string(body), p.config.ErrorMarker) {
+		return fmt.Errorf("provider %s returned an error page", p.config.Name)
+	}
+	return validateHTML(header, body)
+}
+
+func (p *Generic) Credits(header http.Header) (float64, bool) {
+	if p.config.CreditsHeader == "" {
+		return 0, false
+	}
+
+	remaining, err := strconv.ParseFloat(strings.TrimSpace(header.Get(p.config.CreditsHeader)), 64)
+	if err != nil {
+		return 0, false
+	}
+	return remaining, true
+}
+
+func (p *Generic) Cost(header http.Header) float64 {
+	return headerFloat(header, p.config.CostHeader, p.config.CreditsPerRequest)
+}
+
+func (p *Generic) Limits() Limits {
+	return Limits{Concurrency: p.config.Concurrency, BatchSize: p.config.BatchSize}
+}
@@ -0,0 +1,166 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kbbi-scraper/internal/common"
+)
+
+// Rotation policies for the exit IP of a provider or proxy pool.
+const (
+	// ROTATE_REQUEST lets every request leave from a new IP.
+	ROTATE_REQUEST = "request"
+	// ROTATE_SESSION keeps one exit IP for a KBBI login session and all
+	// of its searches, until StickyTTL passes or the IP gets refused.
+	ROTATE_SESSION = "session"
+)
+
+// GeoConfig selects where requests leave from.
+type GeoConfig struct {
+	Country   string
+	Rotation  string
+	StickyTTL time.Duration
+}
+
+// GeoProvider is implemented by providers that let us choose the exit
+// country and pin the exit IP with a session ID.
+type GeoProvider interface {
+	Geo() GeoConfig
+	SetGeo(GeoConfig)
+}
+
+// Sticky reports whether requests should share a session ID.
+func (g GeoConfig) Sticky() bool {
+	return g.Rotation == ROTATE_SESSION
+}
+
+// LoadGeoConfig reads <NAME>_COUNTRY, <NAME>_ROTATION and <NAME>_STICKY_TTL,
+// falling back to PROXY_COUNTRY, PROXY_ROTATION and PROXY_STICKY_TTL, then
+// to fallback.
+func LoadGeoConfig(name string, fallback GeoConfig) GeoConfig {
+	prefix := envPrefix(name)
+
+	config := GeoConfig{
+		Country:   common.GetEnvString("PROXY_COUNTRY", fallback.Country),
+		Rotation:  common.GetEnvString("PROXY_ROTATION", fallback.Rotation),
+		StickyTTL: common.GetEnvDuration("PROXY_STICKY_TTL", fallback.StickyTTL),
+	}
+	config.Country = common.GetEnvString(prefix+"_COUNTRY", config.Country)
+	config.Rotation = strings.ToLower(common.GetEnvString(prefix+"_ROTATION", config.Rotation))
+	config.StickyTTL = common.GetEnvDuration(prefix+"_STICKY_TTL", config.StickyTTL)
+
+	switch config.Rotation {
+	case ROTATE_REQUEST, ROTATE_SESSION:
+	case "":
+		config.Rotation = ROTATE_REQUEST
+	default:
+		common.PrintWarning("Invalid rotation policy for %s: %q, using %s", name, config.Rotation, ROTATE_REQUEST)
+		config.Rotation = ROTATE_REQUEST
+	}
+
+	return config
+}
+
+// LoadGeo applies the geo configuration from the environment to every
+// registered provider that supports it.
+func LoadGeo() {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for name, p := range registry {
+		if gp, ok := p.(GeoProvider); ok {
+			gp.SetGeo(LoadGeoConfig(name, gp.Geo()))
+		}
+	}
+}
+
+func envPrefix(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// StickySession hands out the session ID that pins the exit IP of one KBBI
+// session. A new ID is drawn once the TTL passes or after Rotate.
+type StickySession struct {
+	mu      sync.Mutex
+	id      string
+	created time.Time
+}
+
+// ID returns the current session ID for config, or "" when config rotates
+// per request.
+func (s *StickySession) ID(config GeoConfig) string {
+	if s == nil || !config.Sticky() {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.id == "" || (config.StickyTTL > 0 && time.Since(s.created) > config.StickyTTL) {
+		s.id = NewSessionID()
+		s.created = time.Now()
+	}
+	return s.id
+}
+
+// Rotate drops the current ID so the next request gets a new exit IP.
+func (s *StickySession) Rotate() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.id = ""
+}
+
+// NewSessionID returns a random numeric session ID, the format every
+// supported provider accepts.
+func NewSessionID() string {
+	return strconv.Itoa(rand.Intn(9_999_999) + 1)
+}
+
+func geoOf(p Provider) GeoConfig {
+	if gp, ok := p.(GeoProvider); ok {
+		return gp.Geo()
+	}
+	return GeoConfig{Rotation: ROTATE_REQUEST}
+}
+
+// SessionID returns the session ID sticky gives requests through p.
+func SessionID(p Provider, sticky *StickySession) string {
+	return sticky.ID(geoOf(p))
+}
+
+func expandTemplate(raw, country, session string) string {
+	return strings.NewReplacer("{country}", country, "{session}", session).Replace(raw)
+}
@@ -0,0 +1,154 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"kbbi-scraper/internal/common"
+)
+
+var ErrCreditBudgetReached = fmt.Errorf("estimated proxy credit budget reached")
+
+type ProviderUsage struct {
+	Name             string
+	Requests         int
+	Successes        int
+	Failures         int
+	Credits          float64
+	RemainingCredits float64
+	HasRemaining     bool
+}
+
+// Ledger counts the requests and estimated credits spent per provider
+// during one run and stops the run once Budget credits are used. It is a
+// local count, not the provider's own balance: a request costs what the
+// provider's cost header says, or its nominal price when there is none.
+type Ledger struct {
+	mu     sync.Mutex
+	usage  map[string]*ProviderUsage
+	budget float64
+}
+
+func NewLedger(budget float64) *Ledger {
+	return &Ledger{
+		usage:  map[string]*ProviderUsage{},
+		budget: budget,
+	}
+}
+
+// LoadLedger reads the credit budget of the run from PROXY_CREDIT_BUDGET,
+// or from PROXY_SPEND_CAP, its old name. Zero means no budget.
+func LoadLedger() *Ledger {
+	budget := common.GetEnvFloat("PROXY_SPEND_CAP", 0)
+	if budget > 0 {
+		common.PrintWarning("PROXY_SPEND_CAP is deprecated, use PROXY_CREDIT_BUDGET")
+	}
+	return NewLedger(common.GetEnvFloat("PROXY_CREDIT_BUDGET", budget))
+}
+
+func (l *Ledger) get(provider string) *ProviderUsage {
+	usage, ok := l.usage[provider]
+	if !ok {
+		usage = &ProviderUsage{Name: provider}
+		l.usage[provider] = usage
+	}
+	return usage
+}
+
+func (l *Ledger) Record(provider string, credits float64, success bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage := l.get(provider)
+	usage.Requests++
+	usage.Credits += credits
+	if success {
+		usage.Successes++
+	} else {
+		usage.Failures++
+	}
+}
+
+func (l *Ledger) SetRemaining(provider string, remaining float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage := l.get(provider)
+	usage.RemainingCredits = remaining
+	usage.HasRemaining = true
+}
+
+func (l *Ledger) Total() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	total := 0.0
+	for _, usage := range l.usage {
+		total += usage.Credits
+	}
+	return total
+}
+
+// Budget is the estimated credits the run may spend, zero when there is
+// no budget.
+func (l *Ledger) Budget() float64 {
+	return l.budget
+}
+
+func (l *Ledger) Exceeded() bool {
+	return l.budget > 0 && l.Total() >= l.budget
+}
+
+func (l *Ledger) Summary() []ProviderUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	summary := make([]ProviderUsage, 0, len(l.usage))
+	for _, usage := range l.usage {
+		summary = append(summary, *usage)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		return summary[i].Name < summary[j].Name
+	})
+	return summary
+}
+
+func (l *Ledger) PrintSummary() {
+	summary := l.Summary()
+	if len(summary) == 0 {
+		return
+	}
+
+	common.PrintInfo("Estimated cost summary:")
+	for _, usage := range summary {
+		line := fmt.Sprintf("  %-12s requests=%d ok=%d failed=%d credits=%.1f", usage.Name, usage.Requests, usage.Successes, usage.Failures, usage.Credits)
+		if usage.HasRemaining {
+			line += fmt.Sprintf(" remaining=%.1f", usage.RemainingCredits)
+		}
+		common.Printf("%s\n", line)
+	}
+
+	if l.budget > 0 {
+		common.PrintInfo("Estimated credits: %.1f of %.1f budget", l.Total(), l.budget)
+	} else {
+		common.PrintInfo("Estimated credits: %.1f", l.Total())
+	}
+}
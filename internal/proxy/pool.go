@@ -0,0 +1,409 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"kbbi-scraper/internal/common"
+
+	"github.com/gocolly/colly/v2"
+)
+
+const DEFAULT_HEALTH_URL = "https://kbbi.kemdikbud.go.id/"
+
+// STICKY_IDLE_TIMEOUT is how long an unused session stays pinned to its
+// proxy when no sticky TTL is configured.
+const STICKY_IDLE_TIMEOUT = 30 * time.Minute
+
+var ErrNoHealthyProxy = fmt.Errorf("no healthy proxy available")
+
+type PoolConfig struct {
+	HealthURL     string
+	HealthTimeout time.Duration
+	Cooldown      time.Duration
+	Geo           GeoConfig
+}
+
+// poolEntry is one proxy of the list. Its URL may contain {country} and
+// {session} placeholders, filled in per request for gateways that pick the
+// exit IP from the username.
+type poolEntry struct {
+	raw          string
+	name         string
+	url          *url.URL
+	ejectedUntil time.Time
+	reason       string
+	failures     int
+}
+
+// stickyPin pins a session to a proxy until it is ejected or the session
+// goes unused.
+type stickyPin struct {
+	entry    *poolEntry
+	lastUsed time.Time
+}
+
+type PoolStatus struct {
+	URL          string
+	Healthy      bool
+	EjectedUntil time.Time
+	Reason       string
+	Failures     int
+}
+
+// Pool rotates requests over a list of HTTP, HTTPS and SOCKS5 proxies.
+// Proxies that fail, or whose IP KBBI bans or limits, are ejected and
+// re-admitted once their cooldown has passed. A sticky session stays on
+// the same proxy for as long as it is healthy.
+type Pool struct {
+	mu        sync.Mutex
+	entries   []*poolEntry
+	next      int
+	sticky    map[string]*stickyPin
+	config    PoolConfig
+	transport func(proxyURL *url.URL) http.RoundTripper
+}
+
+func LoadPoolConfig() PoolConfig {
+	return PoolConfig{
+		HealthURL:     common.GetEnvString("PROXY_HEALTH_URL", DEFAULT_HEALTH_URL),
+		HealthTimeout: common.GetEnvDuration("PROXY_HEALTH_TIMEOUT", 15*time.Second),
+		Cooldown:      common.GetEnvDuration("PROXY_COOLDOWN", 10*time.Minute),
+		Geo:           LoadGeoConfig("residential", GeoConfig{Country: "jp", Rotation: ROTATE_REQUEST}),
+	}
+}
+
+// LoadPool builds a pool from PROXY_LIST_FILE (one proxy per line) and
+// PROXY_LIST (comma separated). It returns nil when neither is set.
+func LoadPool() (*Pool, error) {
+	var proxies []string
+
+	if file := os.Getenv("PROXY_LIST_FILE"); file != "" {
+		list, err := readProxyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, list...)
+	}
+
+	proxies = append(proxies, common.GetEnvList("PROXY_LIST")...)
+	if len(proxies) == 0 {
+		return nil, nil
+	}
+
+	return NewPool(proxies, LoadPoolConfig())
+}
+
+func NewPool(proxies []string, config PoolConfig) (*Pool, error) {
+	p := &Pool{config: config, sticky: map[string]*stickyPin{}}
+
+	for _, raw := range proxies {
+		if !strings.Contains(raw, "://") {
+			raw = "http://" + raw
+		}
+
+		u, err := url.Parse(expandTemplate(raw, config.Geo.Country, "session"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", raw, err)
+		}
+
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+
+		entry := &poolEntry{raw: raw, name: u.Redacted()}
+		if !strings.Contains(raw, "{") {
+			entry.url = u
+		}
+		p.entries = append(p.entries, entry)
+	}
+
+	if len(p.entries) == 0 {
+		return nil, fmt.Errorf("proxy list is empty")
+	}
+
+	return p, nil
+}
+
+func readProxyFile(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening proxy list: %w", err)
+	}
+	defer file.Close()
+
+	var proxies []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		proxies = append(proxies, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading proxy list: %w", err)
+	}
+
+	return proxies, nil
+}
+
+// SetTransport builds the health check transport for each proxy, so the
+// checks use the same TLS and dial settings as the scraper.
+func (p *Pool) SetTransport(transport func(proxyURL *url.URL) http.RoundTripper) {
+	p.transport = transport
+}
+
+// CheckHealth requests the health URL through every proxy and ejects the
+// ones that fail. It returns the number of healthy proxies.
+func (p *Pool) CheckHealth() int {
+	var wg sync.WaitGroup
+	for _, entry := range p.entries {
+		wg.Add(1)
+		go func(entry *poolEntry) {
+			defer wg.Done()
+			if err := p.check(entry); err != nil {
+				p.eject(entry, err.Error())
+			}
+		}(entry)
+	}
+	wg.Wait()
+
+	return p.Healthy()
+}
+
+func (p *Pool) check(entry *poolEntry) error {
+	proxyURL := p.resolve(entry, "")
+	if proxyURL == nil {
+		return fmt.Errorf("invalid proxy %s", entry.name)
+	}
+
+	var transport http.RoundTripper = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	if p.transport != nil {
+		transport = p.transport(proxyURL)
+	}
+
+	client := &http.Client{Timeout: p.config.HealthTimeout, Transport: transport}
+
+	resp, err := client.Get(p.config.HealthURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+
+	if strings.HasPrefix(strings.ToLower(resp.Request.URL.Path), "/account/banned") {
+		return fmt.Errorf("health check redirected to the banned page")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(body), "Batas Sehari") {
+		return fmt.Errorf("health check hit the daily limit page")
+	}
+
+	return nil
+}
+
+// SessionID returns the session ID sticky gives requests through the pool,
+// or "" when the pool rotates per request.
+func (p *Pool) SessionID(sticky *StickySession) string {
+	return sticky.ID(p.config.Geo)
+}
+
+// ProxyFunc picks a healthy proxy for each request, in the shape colly
+// expects from SetProxyFunc. Requests with the same non-empty session go
+// through the same proxy and session ID, so they share an exit IP.
+func (p *Pool) ProxyFunc(session string) colly.ProxyFunc {
+	return func(r *http.Request) (*url.URL, error) {
+		entry, err := p.pick(session)
+		if err != nil {
+			return nil, err
+		}
+
+		u := p.resolve(entry, session)
+		if u == nil {
+			return nil, fmt.Errorf("invalid proxy %s", entry.name)
+		}
+
+		ctx := context.WithValue(r.Context(), colly.ProxyURLKey, entry.raw)
+		*r = *r.WithContext(ctx)
+		return u, nil
+	}
+}
+
+func (p *Pool) pick(session string) (*poolEntry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.pruneSticky(now)
+	if pin, ok := p.sticky[session]; ok {
+		pin.lastUsed = now
+		return pin.entry, nil
+	}
+
+	for i := 0; i < len(p.entries); i++ {
+		entry := p.entries[p.next%len(p.entries)]
+		p.next++
+
+		if now.Before(entry.ejectedUntil) {
+			continue
+		}
+		if !entry.ejectedUntil.IsZero() {
+			common.PrintInfo("Re-admitting proxy %s after cooldown", entry.name)
+			entry.ejectedUntil = time.Time{}
+			entry.reason = ""
+		}
+		if session != "" {
+			p.sticky[session] = &stickyPin{entry: entry, lastUsed: now}
+		}
+		return entry, nil
+	}
+
+	return nil, ErrNoHealthyProxy
+}
+
+// pruneSticky drops the pins of sessions that went unused, since a rotated
+// session ID is never asked for again. The caller holds p.mu.
+func (p *Pool) pruneSticky(now time.Time) {
+	idle := p.config.Geo.StickyTTL
+	if idle <= 0 {
+		idle = STICKY_IDLE_TIMEOUT
+	}
+
+	for session, pin := range p.sticky {
+		if now.Sub(pin.lastUsed) > idle {
+			delete(p.sticky, session)
+		}
+	}
+}
+
+// resolve fills in the placeholders of entry. Without a session every
+// request gets a fresh session ID, which makes the gateway rotate.
+func (p *Pool) resolve(entry *poolEntry, session string) *url.URL {
+	if entry.url != nil {
+		return entry.url
+	}
+
+	if session == "" {
+		session = NewSessionID()
+	}
+
+	u, err := url.Parse(expandTemplate(entry.raw, p.config.Geo.Country, session))
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// Report records the outcome of a request made through proxyURL. A
+// non-empty reason ejects the proxy for the configured cooldown, so callers
+// only report failures of the proxy itself, not of KBBI or the page.
+func (p *Pool) Report(proxyURL string, reason string) {
+	if proxyURL == "" || reason == "" {
+		return
+	}
+
+	p.mu.Lock()
+	var found *poolEntry
+	for _, entry := range p.entries {
+		if entry.raw == proxyURL {
+			found = entry
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if found != nil {
+		p.eject(found, reason)
+	}
+}
+
+func (p *Pool) eject(entry *poolEntry, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry.failures++
+	if p.config.Cooldown <= 0 {
+		return
+	}
+
+	entry.reason = reason
+	entry.ejectedUntil = time.Now().Add(p.config.Cooldown)
+	for session, pin := range p.sticky {
+		if pin.entry == entry {
+			delete(p.sticky, session)
+		}
+	}
+	common.PrintWarning("Ejecting proxy %s for %v: %s", entry.name, p.config.Cooldown, reason)
+}
+
+func (p *Pool) Healthy() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	healthy := 0
+	for _, entry := range p.entries {
+		if !now.Before(entry.ejectedUntil) {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+func (p *Pool) Len() int {
+	return len(p.entries)
+}
+
+func (p *Pool) Status() []PoolStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	status := make([]PoolStatus, 0, len(p.entries))
+	for _, entry := range p.entries {
+		status = append(status, PoolStatus{
+			URL:          entry.name,
+			Healthy:      !now.Before(entry.ejectedUntil),
+			EjectedUntil: entry.ejectedUntil,
+			Reason:       entry.reason,
+			Failures:     entry.failures,
+		})
+	}
+	return status
+}
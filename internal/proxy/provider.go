@@ -0,0 +1,180 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"kbbi-scraper/internal/common"
+)
+
+// Provider is a scraping API that fetches the KBBI page on our behalf.
+type Provider interface {
+	Name() string
+	// BuildURL wraps target in the provider request URL. A non-empty cookie
+	// is the KBBI session cookie the provider has to forward, and a
+	// non-empty session asks the provider to keep the same exit IP for
+	// every request carrying it.
+	BuildURL(target string, cookie string, session string) (string, error)
+	// ParseError extracts the provider's message from a failed response.
+	ParseError(statusCode int, body []byte) string
+	// Validate rejects a successful response that is not a KBBI page.
+	Validate(header http.Header, body []byte) error
+	// Credits reads the remaining credits from the response headers.
+	Credits(header http.Header) (remaining float64, ok bool)
+	// Cost returns the credits a request was billed, from the response
+	// headers when the provider reports it and estimated otherwise.
+	Cost(header http.Header) float64
+	Limits() Limits
+}
+
+// HeaderProvider is implemented by providers that expect extra request
+// headers, such as an API key header.
+type HeaderProvider interface {
+	Header() http.Header
+}
+
+type Limits struct {
+	Concurrency int
+	BatchSize   int
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Provider{}
+)
+
+func init() {
+	Register(NewScrapeOps())
+	Register(NewScrapingAnt())
+	Register(NewScraperAPI())
+	Register(NewScrapingBee())
+}
+
+func Register(p Provider) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[p.Name()] = p
+}
+
+func Get(name string) (Provider, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	p, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider: %s", name)
+	}
+	return p, nil
+}
+
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// secretHolder is implemented by providers whose parameter or header names
+// for credentials are configurable.
+type secretHolder interface {
+	Secrets() (params, headers []string)
+}
+
+// Secrets collects the credential parameters and headers of every
+// registered provider, so captures can leave them out.
+func Secrets() (params, headers []string) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for _, p := range registry {
+		if holder, ok := p.(secretHolder); ok {
+			ps, hs := holder.Secrets()
+			params = append(params, ps...)
+			headers = append(headers, hs...)
+		}
+	}
+	return params, headers
+}
+
+func buildURL(endpoint, urlParam, target string, params url.Values) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	q := u.Query()
+	q.Set(urlParam, target)
+	for key, values := range params {
+		for _, value := range values {
+			q.Add(key, value)
+		}
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// parseJSONError returns field of a JSON error body, or the raw body.
+func parseJSONError(body []byte, field string) string {
+	var errorResponse map[string]interface{}
+	if err := json.Unmarshal(body, &errorResponse); err == nil {
+		if detail, ok := errorResponse[field]; ok {
+			return fmt.Sprint(detail)
+		}
+	}
+	return string(body)
+}
+
+// validateHTML rejects JSON answers, which providers send instead of the
+// page when they could not fetch it but still reply with 200.
+func validateHTML(header http.Header, body []byte) error {
+	if strings.Contains(header.Get("Content-Type"), "json") {
+		return fmt.Errorf("provider returned %s instead of the page: %s", header.Get("Content-Type"), parseJSONError(body, "detail"))
+	}
+	return nil
+}
+
+// headerFloat reads a numeric header, falling back when it is missing.
+func headerFloat(header http.Header, key string, fallback float64) float64 {
+	if key == "" || header == nil {
+		return fallback
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(header.Get(key)), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func sessionCookie(cookie string) string {
+	return fmt.Sprintf("%s=%s", common.KBBI_COOKIE_NAME, cookie)
+}
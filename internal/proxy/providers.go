@@ -0,0 +1,230 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type ScrapeOps struct {
+	Endpoint string
+	geo      GeoConfig
+}
+
+func NewScrapeOps() *ScrapeOps {
+	return &ScrapeOps{
+		Endpoint: "https://proxy.scrapeops.io/v1/",
+		geo:      GeoConfig{Country: "jp", Rotation: ROTATE_REQUEST},
+	}
+}
+
+func (p *ScrapeOps) Name() string { return "scrapeops" }
+
+func (p *ScrapeOps) Geo() GeoConfig { return p.geo }
+
+func (p *ScrapeOps) SetGeo(geo GeoConfig) { p.geo = geo }
+
+func (p *ScrapeOps) BuildURL(target string, cookie string, session string) (string, error) {
+	params := url.Values{}
+	if p.geo.Country != "" {
+		params.Set("country", p.geo.Country)
+	}
+	params.Set("api_key", os.Getenv("SCRAPE_OPS"))
+	if cookie != "" {
+		params.Set("keep_headers", "true")
+	}
+	if session != "" {
+		params.Set("session_number", session)
+	}
+	return buildURL(p.Endpoint, "url", target, params)
+}
+
+func (p *ScrapeOps) ParseError(statusCode int, body []byte) string {
+	return parseJSONError(body, "detail")
+}
+
+func (p *ScrapeOps) Validate(header http.Header, body []byte) error {
+	return validateHTML(header, body)
+}
+
+// Credits and Cost are estimates: no ScrapeOps response header is read for
+// them, so every request counts as one credit.
+func (p *ScrapeOps) Credits(header http.Header) (float64, bool) { return 0, false }
+
+func (p *ScrapeOps) Cost(header http.Header) float64 { return 1 }
+
+func (p *ScrapeOps) Limits() Limits { return Limits{Concurrency: 1, BatchSize: 10} }
+
+type ScrapingAnt struct {
+	Endpoint string
+	geo      GeoConfig
+}
+
+func NewScrapingAnt() *ScrapingAnt {
+	return &ScrapingAnt{
+		Endpoint: "https://api.scrapingant.com/v2/general",
+		geo:      GeoConfig{Country: "ID", Rotation: ROTATE_REQUEST},
+	}
+}
+
+func (p *ScrapingAnt) Name() string { return "scrapingant" }
+
+func (p *ScrapingAnt) Geo() GeoConfig { return p.geo }
+
+// SetGeo only takes the country: ScrapingAnt has no sticky sessions, so
+// every request may leave from a different IP.
+func (p *ScrapingAnt) SetGeo(geo GeoConfig) {
+	p.geo = GeoConfig{Country: geo.Country, Rotation: ROTATE_REQUEST}
+}
+
+func (p *ScrapingAnt) BuildURL(target string, cookie string, session string) (string, error) {
+	params := url.Values{}
+	params.Set("browser", "false")
+	if p.geo.Country != "" {
+		params.Set("proxy_country", p.geo.Country)
+	}
+	params.Set("x-api-key", os.Getenv("SCRAPING_ANT"))
+	if cookie != "" {
+		params.Set("cookies", sessionCookie(cookie))
+	}
+	return buildURL(p.Endpoint, "url", target, params)
+}
+
+func (p *ScrapingAnt) ParseError(statusCode int, body []byte) string {
+	return parseJSONError(body, "detail")
+}
+
+func (p *ScrapingAnt) Validate(header http.Header, body []byte) error {
+	return validateHTML(header, body)
+}
+
+// Credits and Cost are estimates, one credit per request, as no ScrapingAnt
+// response header is read for them.
+func (p *ScrapingAnt) Credits(header http.Header) (float64, bool) { return 0, false }
+
+func (p *ScrapingAnt) Cost(header http.Header) float64 { return 1 }
+
+func (p *ScrapingAnt) Limits() Limits { return Limits{Concurrency: 1, BatchSize: 10} }
+
+type ScraperAPI struct {
+	Endpoint string
+	geo      GeoConfig
+}
+
+func NewScraperAPI() *ScraperAPI {
+	return &ScraperAPI{
+		Endpoint: "http://api.scraperapi.com",
+		geo:      GeoConfig{Rotation: ROTATE_REQUEST},
+	}
+}
+
+func (p *ScraperAPI) Name() string { return "scraperapi" }
+
+func (p *ScraperAPI) Geo() GeoConfig { return p.geo }
+
+func (p *ScraperAPI) SetGeo(geo GeoConfig) { p.geo = geo }
+
+func (p *ScraperAPI) BuildURL(target string, cookie string, session string) (string, error) {
+	params := url.Values{}
+	params.Set("api_key", os.Getenv("SCRAPER_API"))
+	if cookie != "" {
+		params.Set("keep_headers", "true")
+	}
+	if p.geo.Country != "" {
+		params.Set("country_code", strings.ToLower(p.geo.Country))
+	}
+	if session != "" {
+		params.Set("session_number", session)
+	}
+	return buildURL(p.Endpoint, "url", target, params)
+}
+
+func (p *ScraperAPI) ParseError(statusCode int, body []byte) string {
+	return parseJSONError(body, "detail")
+}
+
+func (p *ScraperAPI) Validate(header http.Header, body []byte) error {
+	return validateHTML(header, body)
+}
+
+// Credits and Cost are estimates: ScraperAPI only reports usage through its
+// account endpoint, so every request counts as one credit.
+func (p *ScraperAPI) Credits(header http.Header) (float64, bool) { return 0, false }
+
+func (p *ScraperAPI) Cost(header http.Header) float64 { return 1 }
+
+func (p *ScraperAPI) Limits() Limits { return Limits{Concurrency: 5, BatchSize: 50} }
+
+type ScrapingBee struct {
+	Endpoint string
+	geo      GeoConfig
+}
+
+func NewScrapingBee() *ScrapingBee {
+	return &ScrapingBee{
+		Endpoint: "https://app.scrapingbee.com/api/v1/",
+		geo:      GeoConfig{Rotation: ROTATE_REQUEST},
+	}
+}
+
+func (p *ScrapingBee) Name() string { return "scrapingbee" }
+
+func (p *ScrapingBee) Geo() GeoConfig { return p.geo }
+
+func (p *ScrapingBee) SetGeo(geo GeoConfig) { p.geo = geo }
+
+// BuildURL asks for premium proxies when a country is set, since
+// ScrapingBee only geotargets those.
+func (p *ScrapingBee) BuildURL(target string, cookie string, session string) (string, error) {
+	params := url.Values{}
+	params.Set("render_js", "false")
+	params.Set("api_key", os.Getenv("SCRAPING_BEE"))
+	if cookie != "" {
+		params.Set("cookies", sessionCookie(cookie))
+	}
+	if p.geo.Country != "" {
+		params.Set("premium_proxy", "true")
+		params.Set("country_code", strings.ToLower(p.geo.Country))
+	}
+	if session != "" {
+		params.Set("session_id", session)
+	}
+	return buildURL(p.Endpoint, "url", target, params)
+}
+
+func (p *ScrapingBee) ParseError(statusCode int, body []byte) string {
+	return parseJSONError(body, "detail")
+}
+
+func (p *ScrapingBee) Validate(header http.Header, body []byte) error {
+	return validateHTML(header, body)
+}
+
+// Credits is unknown, as ScrapingBee reports the remaining credits only
+// through its usage endpoint.
+func (p *ScrapingBee) Credits(header http.Header) (float64, bool) { return 0, false }
+
+// Cost reads the Spb-cost header ScrapingBee sends with every response.
+func (p *ScrapingBee) Cost(header http.Header) float64 {
+	return headerFloat(header, "Spb-cost", 1)
+}
+
+func (p *ScrapingBee) Limits() Limits { return Limits{Concurrency: 5, BatchSize: 50} }
@@ -0,0 +1,393 @@
+/*
+ *  Copyright (c) 2024 Nizar Izzuddin Yatim Fadlan <hello@nizarfadlan.dev>
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"kbbi-scraper/internal/common"
+)
+
+const DEFAULT_CAPTURE_FILE = "capture.har.jsonl"
+
+type Mode string
+
+const (
+	ModeOff    Mode = "off"
+	ModeRecord Mode = "record"
+	ModeReplay Mode = "replay"
+)
+
+var ErrNotRecorded = errors.New("no recorded response")
+
+// redactedParams are query parameters that carry provider API keys or, in
+// the case of cookies, the KBBI session cookie forwarded by a provider.
+var redactedParams = []string{"api_key", "x-api-key", "apikey", "token", "cookies"}
+
+// redactedHeaders are request headers that carry credentials.
+var redactedHeaders = []string{"Cookie", "Authorization"}
+
+// redactedFields are form fields that must not leave the machine.
+var redactedFields = []string{"KataSandi", "__RequestVerificationToken"}
+
+// Redact adds query parameters and request headers that carry secrets,
+// such as those named in a provider config, to the redacted ones. It has to
+// be called before the first request is recorded or replayed.
+func Redact(params, headers []string) {
+	for _, param := range params {
+		if param != "" && !slices.Contains(redactedParams, param) {
+			redactedParams = append(redactedParams, param)
+		}
+	}
+	for _, header := range headers {
+		if header != "" && !slices.Contains(redactedHeaders, header) {
+			redactedHeaders = append(redactedHeaders, header)
+		}
+	}
+}
+
+// Entry is one request/response pair, shaped after a HAR entry with the
+// provider that served it added as _provider.
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"`
+	Provider        string    `json:"_provider"`
+	Key             string    `json:"_key"`
+	Request         Request   `json:"request"`
+	Response        Response  `json:"response"`
+	Error           string    `json:"_error,omitempty"`
+}
+
+type Request struct {
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Headers  http.Header `json:"headers"`
+	PostData string      `json:"postData,omitempty"`
+}
+
+type Response struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers"`
+	Content Content     `json:"content"`
+}
+
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// Recorder writes every exchange to a capture file, or serves requests from
+// one without touching the network.
+type Recorder struct {
+	mode Mode
+
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	entries map[string][]*Entry
+	served  map[string]int
+}
+
+// Load reads HTTP_CAPTURE_MODE (off, record or replay) and
+// HTTP_CAPTURE_FILE. It returns nil when capturing is off.
+func Load() (*Recorder, error) {
+	mode := Mode(common.GetEnvString("HTTP_CAPTURE_MODE", string(ModeOff)))
+	path := common.GetEnvString("HTTP_CAPTURE_FILE", DEFAULT_CAPTURE_FILE)
+
+	switch mode {
+	case ModeOff:
+		return nil, nil
+	case ModeRecord:
+		return NewRecorder(path)
+	case ModeReplay:
+		return NewReplayer(path)
+	default:
+		return nil, fmt.Errorf("unknown HTTP_CAPTURE_MODE %q", mode)
+	}
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening capture file: %w", err)
+	}
+
+	common.PrintInfo("Recording HTTP traffic to %s", path)
+	return &Recorder{
+		mode:   ModeRecord,
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+func NewReplayer(path string) (*Recorder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening capture file: %w", err)
+	}
+	defer file.Close()
+
+	r := &Recorder{
+		mode:    ModeReplay,
+		entries: map[string][]*Entry{},
+		served:  map[string]int{},
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	count := 0
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("error parsing capture file: %w", err)
+		}
+		r.entries[entry.Key] = append(r.entries[entry.Key], &entry)
+		count++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading capture file: %w", err)
+	}
+
+	common.PrintInfo("Replaying %d recorded exchanges from %s", count, path)
+	return r, nil
+}
+
+func (r *Recorder) Mode() Mode {
+	return r.mode
+}
+
+func (r *Recorder) Close() error {
+	if r.file == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.writer.Flush(); err != nil {
+		return err
+	}
+	return r.file.Close()
+}
+
+// Transport wraps next for recording, or replaces it when replaying.
+// provider names who serves the requests of this transport.
+func (r *Recorder) Transport(next http.RoundTripper, provider string) http.RoundTripper {
+	return &transport{recorder: r, next: next, provider: provider}
+}
+
+type transport struct {
+	recorder *Recorder
+	next     http.RoundTripper
+	provider string
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.recorder.mode == ModeReplay {
+		return t.recorder.replay(req)
+	}
+
+	var postData []byte
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		postData = body
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	started := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	entry := &Entry{
+		StartedDateTime: started,
+		Time:            float64(time.Since(started).Microseconds()) / 1000,
+		Provider:        t.provider,
+		Key:             requestKey(req),
+		Request: Request{
+			Method:   req.Method,
+			URL:      redactURL(req.URL),
+			Headers:  redactHeader(req.Header, redactedHeaders...),
+			PostData: redactForm(postData),
+		},
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+		t.recorder.write(entry)
+		return nil, err
+	}
+
+	body, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	entry.Response = Response{
+		Status:  resp.StatusCode,
+		Headers: redactHeader(resp.Header, "Set-Cookie"),
+		Content: Content{
+			Size:     len(body),
+			MimeType: resp.Header.Get("Content-Type"),
+			Text:     string(body),
+		},
+	}
+	if readErr != nil {
+		entry.Error = readErr.Error()
+		t.recorder.write(entry)
+		return nil, readErr
+	}
+
+	t.recorder.write(entry)
+	return resp, nil
+}
+
+func (r *Recorder) write(entry *Entry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		common.LogError("Error marshaling capture entry", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.writer.Write(data)
+	r.writer.WriteByte('\n')
+	if err := r.writer.Flush(); err != nil {
+		common.LogError("Error writing capture entry", err)
+	}
+}
+
+// replay serves the recorded responses for a request in the order they
+// were captured, repeating the last one once they run out.
+func (r *Recorder) replay(req *http.Request) (*http.Response, error) {
+	key := requestKey(req)
+
+	r.mu.Lock()
+	entries := r.entries[key]
+	if len(entries) == 0 {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%s: %w", key, ErrNotRecorded)
+	}
+	index := r.served[key]
+	if index >= len(entries) {
+		index = len(entries) - 1
+	}
+	r.served[key] = index + 1
+	entry := entries[index]
+	r.mu.Unlock()
+
+	if entry.Error != "" && entry.Response.Status == 0 {
+		return nil, errors.New(entry.Error)
+	}
+
+	header := entry.Response.Headers.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Response.Status, http.StatusText(entry.Response.Status)),
+		StatusCode:    entry.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(entry.Response.Content.Text)),
+		ContentLength: int64(len(entry.Response.Content.Text)),
+		Request:       req,
+	}, nil
+}
+
+// requestKey identifies a request independently of the provider that
+// carried it, so a capture made through one provider replays for another.
+func requestKey(req *http.Request) string {
+	u := req.URL
+	if canonical := common.CanonicalKBBIURL(u); canonical != nil {
+		u = canonical
+	} else {
+		u = redactedURL(u)
+	}
+	return req.Method + " " + u.String()
+}
+
+func redactURL(u *url.URL) string {
+	return redactedURL(u).String()
+}
+
+func redactedURL(u *url.URL) *url.URL {
+	redacted := *u
+	q := redacted.Query()
+	for _, param := range redactedParams {
+		if q.Has(param) {
+			q.Set(param, "REDACTED")
+		}
+	}
+	redacted.RawQuery = q.Encode()
+	redacted.User = nil
+	return &redacted
+}
+
+func redactHeader(header http.Header, keys ...string) http.Header {
+	redacted := header.Clone()
+	for _, key := range keys {
+		values := redacted.Values(key)
+		for i, value := range values {
+			name, _, found := strings.Cut(value, "=")
+			if found {
+				values[i] = name + "=REDACTED"
+			} else {
+				values[i] = "REDACTED"
+			}
+		}
+	}
+	return redacted
+}
+
+func redactForm(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return string(body)
+	}
+	for _, field := range redactedFields {
+		if values.Has(field) {
+			values.Set(field, "REDACTED")
+		}
+	}
+	return values.Encode()
+}